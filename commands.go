@@ -0,0 +1,68 @@
+package hipchat
+
+import (
+	"strings"
+	"unicode"
+)
+
+// A Command is a message that starts with a command prefix, such as
+// "!deploy api 'release 2'". Name is the word following the prefix, "deploy",
+// and Args the words after it, "api" and "release 2". Source is the message
+// the command was parsed from.
+type Command struct {
+	Name   string
+	Args   []string
+	Source *Message
+}
+
+// ParseCommand parses the body of m as a command starting with prefix, such
+// as "!" or "/". Arguments are separated by spaces; single or double quotes
+// keep spaces in an argument and a backslash escapes the next character. It
+// returns nil if the body does not start with prefix followed by a name.
+func ParseCommand(prefix string, m *Message) *Command {
+	body := strings.TrimSpace(m.Body)
+	if prefix == "" || !strings.HasPrefix(body, prefix) {
+		return nil
+	}
+	words := splitArgs(body[len(prefix):])
+	if len(words) == 0 || strings.HasPrefix(body[len(prefix):], " ") {
+		return nil
+	}
+	return &Command{Name: words[0], Args: words[1:], Source: m}
+}
+
+// splitArgs splits s into words at unquoted spaces.
+func splitArgs(s string) []string {
+	var words []string
+	var word strings.Builder
+	var quote rune
+	inWord, escaped := false, false
+	for _, r := range s {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			inWord, escaped = true, true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			word.WriteRune(r)
+		case r == '"' || r == '\'':
+			inWord, quote = true, r
+		case unicode.IsSpace(r):
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			inWord = true
+			word.WriteRune(r)
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words
+}
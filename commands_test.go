@@ -0,0 +1,84 @@
+package hipchat
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mackross/go-hipchat/hipchattest"
+)
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		prefix string
+		body   string
+		name   string
+		args   []string
+	}{
+		{"!", "!deploy api 'release 2'", "deploy", []string{"api", "release 2"}},
+		{"!", "  !status  ", "status", []string{}},
+		{"/", `/say "hello world" again`, "say", []string{"hello world", "again"}},
+		{"!", `!echo don\'t a\ b`, "echo", []string{"don't", "a b"}},
+		{"!", `!echo "" x`, "echo", []string{"", "x"}},
+		{"!", `!echo "it's"`, "echo", []string{"it's"}},
+		{"!", "!echo 'unterminated arg", "echo", []string{"unterminated arg"}},
+		{"!", "!ping\tnow", "ping", []string{"now"}},
+		{"!", "! deploy", "", nil},
+		{"!", "!", "", nil},
+		{"!", "deploy", "", nil},
+		{"", "!deploy", "", nil},
+	}
+	for _, tt := range tests {
+		m := &Message{Body: tt.body}
+		cmd := ParseCommand(tt.prefix, m)
+		if tt.name == "" {
+			if cmd != nil {
+				t.Errorf("ParseCommand(%q, %q) = %+v, want nil", tt.prefix, tt.body, cmd)
+			}
+			continue
+		}
+		if cmd == nil {
+			t.Errorf("ParseCommand(%q, %q) = nil", tt.prefix, tt.body)
+			continue
+		}
+		if cmd.Name != tt.name || !reflect.DeepEqual(cmd.Args, tt.args) || cmd.Source != m {
+			t.Errorf("ParseCommand(%q, %q) = %q %q, want %q %q", tt.prefix, tt.body, cmd.Name, cmd.Args, tt.name, tt.args)
+		}
+	}
+}
+
+func TestCommands(t *testing.T) {
+	const dev = "1_dev@conf.hipchat.com"
+	server := hipchattest.NewServer(append(hipchattest.Login(),
+		hipchattest.Step{Expect: dev + "/Bot"},
+		// the client's own command is left out, as are other messages
+		hipchattest.Step{Expect: "<body>go</body>", Reply: groupchat(dev, "Bot", "!own") + chat("hello") + chat("!deploy api")},
+	)...)
+	c := connect(t, server)
+	commands := c.Commands("!")
+	if err := c.Join(dev, "Bot"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Say("1_2@chat.hipchat.com", "Bot", "go"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case cmd := <-commands:
+		if cmd.Name != "deploy" || !reflect.DeepEqual(cmd.Args, []string{"api"}) {
+			t.Errorf("received %q %q", cmd.Name, cmd.Args)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no command received")
+	}
+
+	c.Disconnect()
+	select {
+	case _, ok := <-commands:
+		if ok {
+			t.Error("received another command")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Commands not closed")
+	}
+}
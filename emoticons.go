@@ -0,0 +1,105 @@
+package hipchat
+
+// An Emoticon is an emoticon shortcut such as "(thumbsup)" found in a message
+// body. Start and End are the byte offsets of the shortcut, parentheses
+// included, within the body.
+type Emoticon struct {
+	Shortcut string
+	Start    int
+	End      int
+}
+
+// maxShortcut is the longest shortcut HipChat accepts for an emoticon.
+const maxShortcut = 32
+
+// unicodeEmoticons maps some of HipChat's standard emoticons to the unicode
+// emoji closest to them.
+var unicodeEmoticons = map[string]string{
+	"thumbsup":     "\U0001F44D",
+	"thumbsdown":   "\U0001F44E",
+	"smile":        "\U0001F604",
+	"wink":         "\U0001F609",
+	"heart":        "❤️",
+	"yey":          "\U0001F389",
+	"success":      "✅",
+	"failed":       "❌",
+	"facepalm":     "\U0001F926",
+	"shrug":        "\U0001F937",
+	"coffee":       "☕",
+	"beer":         "\U0001F37A",
+	"cake":         "\U0001F370",
+	"fire":         "\U0001F525",
+	"sadpanda":     "\U0001F43C",
+	"rocket":       "\U0001F680",
+	"awthanks":     "\U0001F64F",
+	"celebrate":    "\U0001F389",
+	"lol":          "\U0001F602",
+	"wat":          "\U0001F928",
+	"okay":         "\U0001F44C",
+	"hi":           "\U0001F44B",
+	"sweat":        "\U0001F605",
+	"cool":         "\U0001F60E",
+	"pokerface":    "\U0001F610",
+	"stare":        "\U0001F633",
+	"thinking":     "\U0001F914",
+	"allthethings": "\U0001F64C",
+}
+
+// ParseEmoticons returns the emoticon shortcuts in body, in order. A shortcut
+// is a run of ASCII letters and digits in parentheses.
+func ParseEmoticons(body string) []Emoticon {
+	var emoticons []Emoticon
+	for i := 0; i < len(body); i++ {
+		if body[i] != '(' {
+			continue
+		}
+		j := i + 1
+		for j < len(body) && j-i-1 <= maxShortcut && isShortcutByte(body[j]) {
+			j++
+		}
+		if j == i+1 || j-i-1 > maxShortcut || j == len(body) || body[j] != ')' {
+			continue
+		}
+		emoticons = append(emoticons, Emoticon{Shortcut: body[i+1 : j], Start: i, End: j + 1})
+		i = j
+	}
+	return emoticons
+}
+
+// ReplaceEmoticons returns body with every emoticon shortcut replaced by what
+// replace returns for it.
+func ReplaceEmoticons(body string, replace func(Emoticon) string) string {
+	emoticons := ParseEmoticons(body)
+	if len(emoticons) == 0 {
+		return body
+	}
+
+	var b []byte
+	last := 0
+	for _, e := range emoticons {
+		b = append(b, body[last:e.Start]...)
+		b = append(b, replace(e)...)
+		last = e.End
+	}
+	return string(append(b, body[last:]...))
+}
+
+// UnicodeEmoticon is a replacement for ReplaceEmoticons and
+// WithEmoticonReplacer that turns HipChat's standard emoticons into the
+// closest unicode emoji and leaves any others as they are.
+func UnicodeEmoticon(e Emoticon) string {
+	if s, ok := unicodeEmoticons[e.Shortcut]; ok {
+		return s
+	}
+	return "(" + e.Shortcut + ")"
+}
+
+// StripEmoticon is a replacement for ReplaceEmoticons and WithEmoticonReplacer
+// that removes every emoticon.
+func StripEmoticon(e Emoticon) string {
+	return ""
+}
+
+func isShortcutByte(b byte) bool {
+	return b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9'
+}
@@ -2,7 +2,7 @@ package main
 
 import (
 	"fmt"
-	"github.com/daneharrigan/hipchat"
+	"github.com/mackross/go-hipchat"
 )
 
 func main() {
@@ -16,10 +16,16 @@ func main() {
 		return
 	}
 
+	users, err := client.Users()
+	if err != nil {
+		fmt.Printf("users error: %s\n", err)
+		return
+	}
+
 	var fullName string
 	var mentionName string
 
-	for _, user := range client.Users() {
+	for _, user := range users {
 		if user.Id == client.Id {
 			fullName = user.Name
 			mentionName = user.MentionName
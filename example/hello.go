@@ -2,7 +2,7 @@ package main
 
 import (
 	"fmt"
-	"github.com/daneharrigan/hipchat"
+	"github.com/mackross/go-hipchat"
 )
 
 func main() {
@@ -18,8 +18,17 @@ func main() {
 		return
 	}
 
-	client.Status("chat")
-	client.Join(roomJid, fullName)
-	client.Say(roomJid, fullName, "Hello")
+	if err := client.Status("chat"); err != nil {
+		fmt.Printf("status error: %s\n", err)
+		return
+	}
+	if err := client.Join(roomJid, fullName); err != nil {
+		fmt.Printf("join error: %s\n", err)
+		return
+	}
+	if err := client.Say(roomJid, fullName, "Hello"); err != nil {
+		fmt.Printf("say error: %s\n", err)
+		return
+	}
 	select {}
 }
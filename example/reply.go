@@ -2,8 +2,8 @@ package main
 
 import (
 	"fmt"
+	"github.com/mackross/go-hipchat"
 	"strings"
-	"github.com/daneharrigan/hipchat"
 )
 
 func main() {
@@ -20,11 +20,19 @@ func main() {
 		return
 	}
 
-	client.Status("chat")
-	client.Join(roomJid, fullName)
+	if err := client.Status("chat"); err != nil {
+		fmt.Printf("status error: %s\n", err)
+		return
+	}
+	if err := client.Join(roomJid, fullName); err != nil {
+		fmt.Printf("join error: %s\n", err)
+		return
+	}
 	for message := range client.Messages() {
 		if strings.HasPrefix(message.Body, "@"+mentionName) {
-			client.Say(roomJid, fullName, "Hello")
+			if err := client.Say(roomJid, fullName, "Hello"); err != nil {
+				fmt.Printf("say error: %s\n", err)
+			}
 		}
 	}
 }
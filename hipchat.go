@@ -1,20 +1,90 @@
 package hipchat
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"github.com/mackross/go-hipchat/xmpp"
+	"io"
+	"net"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
+)
+
+const (
+	defaultDomain     = "chat.hipchat.com"
+	defaultConfDomain = "conf.hipchat.com"
 )
 
 var (
-	host = "chat.hipchat.com"
-	conf = "conf.hipchat.com"
+	// ErrInvalidJID is returned by NewClient when the user name is empty or
+	// cannot form a valid HipChat JID.
+	ErrInvalidJID = errors.New("invalid jid")
+
+	// ErrNotConnected is returned when sending while the client is not
+	// connected to HipChat, such as while it is reconnecting.
+	ErrNotConnected = errors.New("not connected")
+
+	// ErrInvalidRoom is returned when a nil Room or one without an Id is
+	// given.
+	ErrInvalidRoom = errors.New("invalid room")
+
+	// ErrNotJoined is returned when an operation requires the client to have
+	// joined a room.
+	ErrNotJoined = errors.New("room not joined")
+
+	// ErrNoSupportedAuthMechanism is returned by NewClient when the server
+	// offers none of the ways of authenticating the client supports. The
+	// error returned names the mechanisms the server offered.
+	ErrNoSupportedAuthMechanism = errors.New("no supported authentication mechanism")
+
+	// ErrNotSupported is returned when a user or server does not support a
+	// request.
+	ErrNotSupported = errors.New("not supported")
+
+	// ErrNoEcho is returned by Say when a room did not echo a message back in
+	// time, see WithEchoConfirmation.
+	ErrNoEcho = errors.New("message not echoed by room")
+
+	// ErrNotConfirmed is returned by JoinCodes when the room has not yet
+	// confirmed the join.
+	ErrNotConfirmed = errors.New("join not confirmed")
+
+	// ErrConflict is returned by Err when the client stopped because another
+	// session logged in with the same resource and HipChat disconnected this
+	// one, and by NewClient when HipChat refuses the login because the
+	// resource is in use. See WithReconnectOnConflict.
+	ErrConflict = errors.New("resource in use by another session")
+
+	// ErrAuthzidRefused is returned by NewClient when the server does not let
+	// the account act as the identity set with WithAuthzid.
+	ErrAuthzidRefused = errors.New("authorization identity refused")
+
+	// ErrNoTopic is returned by Topic when the room's topic has not been
+	// received yet.
+	ErrNoTopic = errors.New("topic not received")
+
+	// ErrInvalidInterval is returned by SayEvery when the interval is not
+	// positive.
+	ErrInvalidInterval = errors.New("invalid interval")
 )
 
 // A Client represents the connection between the application to the HipChat
 // service.
+//
+// The channels a Client delivers events on, such as Messages, RosterUpdates
+// and OnReconnect, are created with the client and stay the same when it
+// reconnects; the client rejoins its rooms and fetches its roster again by
+// itself. They are closed after Disconnect, once the client has stopped
+// sending on them, so ranging over one ends when the client is done.
+// MessagesContext channels are closed when their context is done instead.
 type Client struct {
 	Username string
 	Password string
@@ -22,28 +92,421 @@ type Client struct {
 	Id       string
 
 	// private
+	config          config
+	mu              sync.Mutex
+	sending         sync.RWMutex // held for reading while a message is written, see Close
+	connected       bool
+	bytesRead       int64 // by previous connections
+	bytesWritten    int64
+	fullJID         string
+	jid             string // bare JID the client acts as, see JID
 	mentionNames    map[string]string
+	names           map[string]string // roster JID -> display name
+	joined          map[string]string
+	topics          map[string]string
+	topicSetters    map[string]topicSetter
+	occupants       map[string]map[string]*RoomPresence // room -> nick
+	entered         map[string]bool                     // rooms that confirmed the client's join
+	refused         map[string]error                    // rooms that refused the client's join
+	leaving         map[string]*time.Timer              // occupant JID -> leave event waiting to fire
+	lastSeen        map[string]time.Time
+	unsaved         map[string]time.Time // last seen times not saved to the Store yet
+	seenUnsaved     chan struct{}        // signals saveLastSeen that there is something to save
+	saver           sync.WaitGroup
+	history         map[string][]*Message // room -> last messages, oldest first
+	muted           map[string]bool       // muted room ids and user JIDs
+	statuses        map[string]status
+	roomPresence    map[string]status   // room -> presence set by SetRoomPresence
+	serverCaps      *xmpp.Caps          // last advertised by the server
+	capsCache       map[string][]string // caps ver -> features
+	pending         map[string]chan *xmpp.IQ
+	rosterStreams   map[string]func(*User) // iq id -> receiver of each user
+	schedules       map[*Schedule]bool
+	overdue         []*Schedule // came due while not connected, see SayAt
+	joining         map[string]chan error
+	joinCodes       map[string][]int
+	passwords       map[string]string
+	echoes          map[string]chan error // message id -> Say waiting for its echo
 	connection      *xmpp.Conn
-	receivedUsers   chan []*User
-	receivedRooms   chan []*Room
 	receivedMessage chan *Message
+	paused          bool
+	flushing        bool
+	held            []*Message // held back from Messages while paused
+	flusher         sync.WaitGroup
+	subscribers     map[chan *Message]bool
+	handlers        []chan *Message
+	handlerDrops    int64
+	messageDrops    int64
+	heldDrops       int64
+	contextDrops    int64
+	commandDrops    int64
+	mentionDrops    int64
+	rosterUpdates   chan *RosterUpdate
+	mentions        chan *Message
+	systemMessages  chan *Message
+	messageErrors   chan *Message
+	markers         chan *Marker
+	roomStates      chan *RoomState
+	occupantEvents  chan *OccupantEvent
+	subscriptions   chan *Subscription
 	onConnect       chan bool
+	onReconnect     chan ReconnectInfo
+	reconnects      int
+	lastPing        time.Duration
+	handshake       HandshakeTrace
+	forced          error   // reported for a disconnect caused by forceDisconnect
+	stopErr         error   // why the client stopped without Disconnect
+	presence        *status // last sent, to send again on reconnecting
+	dnd             *time.Timer
+	dndPrior        *status // presence to restore when the dnd window ends
+	dndWindow       int     // counts SetDND calls, to ignore stale timers
+	tracer          func(dir Direction, stanza []byte)
+	outgoingFilter  func(body string) string
+	traces          chan trace
+	traceOnce       sync.Once
+	rosterFetched   chan struct{}
+	rosterOnce      sync.Once
+	ready           chan struct{}
+	done            chan struct{}
+	closeOnce       sync.Once
+}
+
+// A Transport opens the connections a Client talks XMPP over. addr is the
+// address set with WithConnectAddr.
+type Transport interface {
+	Dial(addr string) (net.Conn, error)
+}
+
+// An IDGenerator makes ids for stanzas and messages, see WithIDGenerator.
+type IDGenerator interface {
+	NewID() string
+}
+
+// A Direction tells a tracer whether a stanza was received or sent.
+type Direction int
+
+const (
+	Inbound Direction = iota
+	Outbound
+)
+
+func (d Direction) String() string {
+	if d == Outbound {
+		return "out"
+	}
+	return "in"
+}
+
+type trace struct {
+	dir    Direction
+	stanza []byte
 }
 
-// A Message represents a message received from HipChat.
+// A Message represents a message received from HipChat. ID is HipChat's mid for
+// the message, or the stanza's id if it has no mid. Messages with neither are
+// given an id starting with "local-", unique within the process, or one from
+// the IDGenerator set with WithIDGenerator. Replaces is set to the id of the
+// original message when the message is a correction of it. Card is set when the
+// message carries a card, in which case Body holds its fallback text, and Link
+// as well when the card is a preview of a link posted in the message. File is
+// set when a user shared a file, with Body holding the human-readable notice.
+// Delayed is set for messages replayed from a room's history, in which case
+// Time is when the message was originally sent. Error is only set for messages
+// received on MessageErrors. IsOwn is set for messages the client's own account
+// sent, such as its echo in a room. Carbon is set for copies of chats of the
+// account's other sessions, see WithCarbons. Markable is set when the sender
+// asked for chat markers, see MarkReceived and MarkDisplayed. ReplyTo is the id
+// of the message this one replies to, see SayReply.
+//
+// Body is the text of the message with XML entities decoded, so a body sent as
+// "a &lt; b" is received as "a < b". Earlier versions delivered the raw XML
+// of the body instead.
+//
+// The sender is described, as far as it is known, by Room, the id of the room
+// a groupchat message was sent in, Nick, the name the sender appears under in
+// that room, SenderJID, the sender's bare JID, which a room only reveals if it
+// is not anonymous, and Name and MentionName, looked up in the roster by
+// SenderJID. Name falls back to Nick when the sender is not on the roster.
 type Message struct {
+	ID          string
+	From        string
+	To          string
+	Body        string
+	Type        string
+	Room        string
+	Nick        string
+	SenderJID   string
+	Name        string
+	MentionName string
+	Time        time.Time
+	Delayed     bool
+	IsOwn       bool
+	Carbon      bool
+	Markable    bool
+	Replaces    string
+	ReplyTo     string
+	Card        *Card
+	Link        *LinkPreview
+	File        *FileShare
+	Error       *StanzaError
+}
+
+// A Subscription represents a presence subscription stanza from a user. Type
+// is "subscribe" when they ask to see the client's presence, "subscribed" or
+// "unsubscribed" when they answer the client's request and "unsubscribe" when
+// they stop following it. Type is "error", with Error set, when HipChat
+// refused a subscription change the client asked for.
+type Subscription struct {
+	From  string
+	Type  string
+	Error *StanzaError
+}
+
+// An OccupantEvent reports someone other than the client joining ("join") or
+// leaving ("leave") a room the client is in. JID is empty for rooms that do
+// not reveal who their occupants are.
+type OccupantEvent struct {
+	Room string
+	Nick string
+	JID  string
+	Type string
+	Time time.Time
+}
+
+// A RoomState represents the state of a joined room after its number of
+// occupants or its topic changed.
+type RoomState struct {
+	Room      string
+	Occupants int
+	Topic     string
+}
+
+// An Occupant represents someone in a room. Nick is the name they appear
+// under in the room and JID is the user's own JID, when the room reveals it.
+// Joined is when they entered the room, see RoomPresence.
+type Occupant struct {
+	Nick   string
+	JID    string
+	Joined time.Time
+}
+
+// A RoomPresence is the last presence received from a room occupant. JID is
+// the occupant's real JID, empty if the room does not reveal it. Role and
+// Affiliation are the MUC role and affiliation, such as "participant" and
+// "member", and StatusCodes the MUC status codes of the presence. Joined is
+// when the occupant entered the room: for those already there when the client
+// joins, the time the room gives for their presence (XEP-0203) if it gives
+// one, and otherwise when their presence was received.
+type RoomPresence struct {
+	Room        string
+	Nick        string
+	JID         string
+	Show        string
+	Status      string
+	Role        string
+	Affiliation string
+	StatusCodes []int
+	Time        time.Time
+	Joined      time.Time
+}
+
+// An AckPolicy says which acknowledgements the client sends by itself for the
+// messages it receives, see WithAckPolicy. Only messages whose sender asked
+// for an acknowledgement are acknowledged, and never the client's own, carbons
+// or messages replayed from history. Rooms need no acknowledgement of their
+// messages, so there is nothing to set for them beyond chat markers.
+type AckPolicy struct {
+	Receipts bool // answer requests for delivery receipts (XEP-0184) in chats
+	Markers  bool // send a received chat marker for markable messages
+}
+
+// A Marker represents a chat marker, sent to show how far a message has got
+// with its recipient. Type is "received", "displayed" or "acknowledged" and ID
+// is the id of the message it marks.
+type Marker struct {
 	ID   string
+	Type string
 	From string
 	To   string
-	Body string
-	Type string
+	Time time.Time
+}
+
+// A FileShare represents a file shared by a user in a room or chat.
+type FileShare struct {
+	Name         string
+	URL          string
+	Size         int64
+	ThumbnailURL string
+}
+
+// A Card represents the rich attachment HipChat integrations can add to a
+// message.
+type Card struct {
+	Style       string
+	Title       string
+	Description string
+	URL         string
+	Icon        string
+	Thumbnail   string
+	Activity    string
 }
 
-// A User represents a member of the HipChat service.
+// A LinkPreview describes the page behind a link posted in a message, as
+// HipChat unfurls it. HipChat has no element of its own for previews: it
+// attaches them to the message as a card of style "link", from which the
+// preview is taken.
+type LinkPreview struct {
+	URL         string
+	Title       string
+	Description string
+	Image       string
+	Icon        string
+}
+
+// A DiscoInfo describes what an entity, such as a room or the server, is and
+// the protocol features it supports, as reported by service discovery. A
+// room's features include "muc_passwordprotected" and "muc_membersonly" when
+// it is password protected or members only.
+type DiscoInfo struct {
+	Identities []Identity
+	Features   []string
+}
+
+// An Identity is one of the identities an entity reports in a DiscoInfo, for
+// example category "conference" and type "text" for a room.
+type Identity struct {
+	Category string
+	Type     string
+	Name     string
+}
+
+// HasFeature reports whether feature is one of the entity's features.
+func (d *DiscoInfo) HasFeature(feature string) bool {
+	for _, f := range d.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// A User represents a member of the HipChat service. Subscription is the
+// state of the presence subscription between the user and the client, such as
+// "both" or "none", and Groups are the roster groups the user is in.
 type User struct {
-	Id          string
-	Name        string
-	MentionName string
+	Id           string
+	Name         string
+	MentionName  string
+	Subscription string
+	Groups       []string
+}
+
+func newUser(jid, name, mentionName, subscription string, groups []string) *User {
+	if groups == nil {
+		groups = []string{}
+	}
+	return &User{Id: jid, Name: name, MentionName: mentionName, Subscription: subscription, Groups: groups}
+}
+
+// A RosterUpdate represents a change to the roster pushed by HipChat when a
+// user is added, removed or renamed.
+type RosterUpdate struct {
+	User    *User
+	Removed bool
+}
+
+// A StanzaError is returned when HipChat answers a request with an error.
+type StanzaError struct {
+	Type      string // cancel, continue, modify, auth or wait
+	Condition string // such as item-not-found or service-unavailable
+	Text      string
+}
+
+func (e *StanzaError) Error() string {
+	if e.Text != "" {
+		return e.Condition + ": " + e.Text
+	}
+	return e.Condition
+}
+
+// A ReconnectInfo describes a reconnect after the connection to HipChat was
+// lost.
+type ReconnectInfo struct {
+	Count    int           // reconnects since the client was created
+	Attempts int           // connection attempts it took to reconnect
+	Outage   time.Duration // time from the disconnect until reconnecting
+	Err      error         // error that caused the disconnect
+}
+
+// A HandshakeStep is one step of logging in to HipChat: "stream" when a
+// stream is opened, "features" when the server lists its features, "starttls",
+// "tls" once TLS is established, "auth" with the mechanism chosen, "success"
+// or "failure", "bind" and "bound" with the JID the client was bound to.
+// Detail holds what the step involved, such as the features offered.
+type HandshakeStep struct {
+	Step   string
+	Detail string
+	Time   time.Time
+}
+
+// A HandshakeTrace lists the steps of a handshake in order.
+type HandshakeTrace []HandshakeStep
+
+func (t HandshakeTrace) String() string {
+	steps := make([]string, len(t))
+	for i, s := range t {
+		steps[i] = s.Step
+		if s.Detail != "" {
+			steps[i] += " (" + s.Detail + ")"
+		}
+	}
+	return strings.Join(steps, ", ")
+}
+
+// A ConnectionInfo describes the state of the connection to HipChat, for
+// diagnostics. TLSVersion and CipherSuite are the tls package's constants and
+// are zero when TLS is not in use. LastPing is zero until Ping first succeeds.
+type ConnectionInfo struct {
+	Connected    bool
+	FullJID      string
+	TLS          bool
+	TLSVersion   uint16
+	CipherSuite  uint16
+	LastPing     time.Duration
+	Reconnects   int
+	BytesRead    int64
+	BytesWritten int64
+}
+
+// Stats counts the received messages the client had to drop because the
+// application did not keep up with them, none of which can be recovered.
+// MessageDrops counts those dropped because the Messages channel was full,
+// HandlerDrops those dropped because an OnMessage handler's queue was full,
+// HeldDrops those received while paused beyond the limit set with
+// WithPauseBuffer, ContextDrops those dropped because a MessagesContext
+// channel was full, CommandDrops the commands dropped because a Commands
+// channel was full and MentionDrops those dropped because the Mentions channel
+// was full. The client also logs each drop with the message's room and sender,
+// see WithLogger.
+type Stats struct {
+	MessageDrops int64
+	HandlerDrops int64
+	HeldDrops    int64
+	ContextDrops int64
+	CommandDrops int64
+	MentionDrops int64
+}
+
+// topicSetter records who set the topic of a room and when.
+type topicSetter struct {
+	nick string
+	at   time.Time
+}
+
+// status is the last presence received from a user.
+type status struct {
+	show string
+	text string
 }
 
 // A Room represents a room in HipChat the Client can join to communicate with
@@ -54,206 +517,3218 @@ type Room struct {
 }
 
 // NewClient creates a new Client connection from the user name, password and
-// resource passed to it.
-func NewClient(user, pass, resource string) (*Client, error) {
-
+// resource passed to it. Options are applied before connecting. The user name
+// may be given with or without the XMPP domain, "@chat.hipchat.com" by default.
+func NewClient(user, pass, resource string, opts ...Option) (*Client, error) {
 	c := &Client{
-		Username: user,
 		Password: pass,
 		Resource: resource,
-		Id:       user + "@" + host,
 
 		// private
-		mentionNames:    make(map[string]string),
-		receivedUsers:   make(chan []*User),
-		receivedRooms:   make(chan []*Room),
-		receivedMessage: make(chan *Message),
-		onConnect:       make(chan bool),
+		config:        defaultConfig(),
+		mentionNames:  make(map[string]string),
+		names:         make(map[string]string),
+		joined:        make(map[string]string),
+		topics:        make(map[string]string),
+		topicSetters:  make(map[string]topicSetter),
+		occupants:     make(map[string]map[string]*RoomPresence),
+		entered:       make(map[string]bool),
+		refused:       make(map[string]error),
+		leaving:       make(map[string]*time.Timer),
+		lastSeen:      make(map[string]time.Time),
+		unsaved:       make(map[string]time.Time),
+		seenUnsaved:   make(chan struct{}, 1),
+		history:       make(map[string][]*Message),
+		muted:         make(map[string]bool),
+		statuses:      make(map[string]status),
+		subscribers:   make(map[chan *Message]bool),
+		pending:       make(map[string]chan *xmpp.IQ),
+		rosterStreams: make(map[string]func(*User)),
+		schedules:     make(map[*Schedule]bool),
+		capsCache:     make(map[string][]string),
+		joining:       make(map[string]chan error),
+		joinCodes:     make(map[string][]int),
+		passwords:     make(map[string]string),
+		echoes:        make(map[string]chan error),
+		roomPresence:  make(map[string]status),
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.presence = c.config.presence
+	if c.config.connectAddr == "" {
+		c.config.connectAddr = c.config.xmppDomain
+	}
+	if c.config.tlsServerName == "" {
+		c.config.tlsServerName = c.config.xmppDomain
+	}
+	if c.config.confDomain == "" {
+		c.config.confDomain = "conf." + c.config.xmppDomain
+		if c.config.xmppDomain == defaultDomain {
+			c.config.confDomain = defaultConfDomain
+		}
+	}
+
+	if !c.config.anonymous {
+		user, err := normalizeUser(user, c.config.xmppDomain)
+		if err != nil {
+			return nil, err
+		}
+		c.Username = user
+		c.Id = user + "@" + c.config.xmppDomain
+	}
+	c.jid = c.Id
+
+	c.receivedMessage = make(chan *Message, c.config.messageBuffer)
+	c.rosterUpdates = make(chan *RosterUpdate, c.config.rosterBuffer)
+	c.mentions = make(chan *Message, c.config.mentionBuffer)
+	c.systemMessages = make(chan *Message, c.config.systemBuffer)
+	c.messageErrors = make(chan *Message, c.config.errorBuffer)
+	c.markers = make(chan *Marker, c.config.markerBuffer)
+	c.roomStates = make(chan *RoomState, c.config.roomStateBuffer)
+	c.occupantEvents = make(chan *OccupantEvent, c.config.occupantBuffer)
+	c.subscriptions = make(chan *Subscription, c.config.subscribeBuffer)
+	c.onConnect = make(chan bool, c.config.connectBuffer)
+	c.onReconnect = make(chan ReconnectInfo, c.config.reconnectBuffer)
+	c.traces = make(chan trace, 256)
+	c.rosterFetched = make(chan struct{})
+	c.ready = make(chan struct{})
+	c.done = make(chan struct{})
+
+	if err := c.connect(); err != nil {
+		return c, err
+	}
+	go c.listen()
+	go c.initialize()
+	if c.config.presenceRefresh > 0 {
+		go c.refreshPresence(c.config.presenceRefresh)
+	}
+	if c.config.store != nil {
+		c.saver.Add(1)
+		go c.saveLastSeen()
+	}
+	return c, nil
+}
+
+// normalizeUser strips the domain from a bare JID and checks that what remains
+// is a valid JID local part.
+func normalizeUser(user, domain string) (string, error) {
+	if i := strings.Index(user, "@"); i != -1 {
+		if user[i+1:] != domain {
+			return "", ErrInvalidJID
+		}
+		user = user[:i]
 	}
 
-	err := c.connect()
-	return c, err
+	if user == "" || strings.ContainsAny(user, "\"&'/:<>@ \t\r\n") {
+		return "", ErrInvalidJID
+	}
+	return user, nil
+}
+
+// dial opens a new connection to the XMPP server.
+func (c *Client) dial() (*xmpp.Conn, error) {
+	if c.config.transport == nil {
+		return xmpp.Dial(c.config.connectAddr)
+	}
+	conn, err := c.config.transport.Dial(c.config.connectAddr)
+	if err != nil {
+		return new(xmpp.Conn), err
+	}
+	return xmpp.NewConn(conn), nil
 }
 
 func (c *Client) connect() error {
-	connection, err := xmpp.Dial(host)
-	c.connection = connection
+	if c.config.anonymous {
+		// the last anonymous JID belonged to that session, and the server
+		// assigns a new one to this
+		c.mu.Lock()
+		c.jid = c.Id
+		c.mu.Unlock()
+	}
+	connection, err := c.dial()
+	c.mu.Lock()
 	if err != nil {
+		// keep the last connection for its byte counts, but a client must
+		// always have one, even if it never connected
+		if c.connection == nil {
+			c.connection = connection
+		}
+		c.mu.Unlock()
 		return err
 	}
+	if c.connection != nil {
+		c.bytesRead += c.connection.BytesRead()
+		c.bytesWritten += c.connection.BytesWritten()
+	}
+	c.connection = connection
+	if c.tracer != nil {
+		connection.SetTracer(c.trace)
+	}
+	if c.config.ids != nil {
+		connection.SetIDGenerator(c.config.ids)
+	}
+	connection.SetLimits(c.config.maxStanzaSize, c.config.maxDepth)
+	c.mu.Unlock()
+	if c.config.tcpKeepAlive != 0 {
+		if err := connection.SetTCPKeepAlive(c.config.tcpKeepAlive); err != nil {
+			connection.Close()
+			return err
+		}
+	}
 	err = c.authenticate()
 	if err != nil {
 		return err
 	}
-	go c.listen()
-	go func() { c.onConnect <- true }()
+
+	c.mu.Lock()
+	c.connected = true
+	presence := c.presence
+	c.mu.Unlock()
+
+	if presence != nil {
+		c.sendPresence(c.connection, presence)
+	}
+	c.mu.Lock()
+	caps := c.serverCaps
+	c.mu.Unlock()
+	if caps != nil {
+		go c.resolveServerCaps(caps)
+	}
+
+	// fetch the roster to learn our own mention name
+	if !c.config.anonymous {
+		c.connection.Roster(c.connection.NewID(), c.JID(), c.config.xmppDomain)
+	}
+	if c.config.carbons {
+		c.connection.EnableCarbons(c.FullJID())
+	}
+	select {
+	case c.onConnect <- true:
+	default:
+	}
 	return nil
 }
 
-// OnConnect returns a read-only channel of booleans and sends true
-// when ever the client connects or reconnects.
-func (c *Client) OnConnect() <-chan bool {
-	return c.onConnect
+// JID returns the bare JID the client acts as. It is Id, except that anonymous
+// logins and logins with WithAuthzid act as the JID HipChat bound the client
+// to when it last connected, which Id does not change to.
+func (c *Client) JID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.jid
 }
 
-// Messages returns a read-only channel of Message structs. After joining a
-// room, messages will be sent on the channel.
-func (c *Client) Messages() <-chan *Message {
-	return c.receivedMessage
+// FullJID returns the full JID, including the resource, that HipChat bound
+// the client to when it last connected.
+func (c *Client) FullJID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.fullJID
 }
 
-// Rooms returns an slice of Room structs.
-func (c *Client) Rooms() []*Room {
-	c.requestRooms()
-	return <-c.receivedRooms
+// BytesRead returns the number of bytes read from HipChat since the client was
+// created, including all previous connections.
+func (c *Client) BytesRead() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bytesRead + c.connection.BytesRead()
 }
 
-// Users returns a slice of User structs.
-func (c *Client) Users() []*User {
-	c.requestUsers()
-	return <-c.receivedUsers
+// BytesWritten returns the number of bytes written to HipChat since the client
+// was created, including all previous connections.
+func (c *Client) BytesWritten() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bytesWritten + c.connection.BytesWritten()
 }
 
-// Status sends a string to HipChat to indicate whether the client is available
-// to chat, away or idle.
-func (c *Client) Status(s string) {
-	c.connection.Presence(c.Id, s)
+// SetTracer sets a function that is called with every stanza sent to and
+// received from HipChat, for debugging the protocol. It is called from its own
+// goroutine, in the order the stanzas were traced, so it never holds up the
+// connection; stanzas are dropped if it falls too far behind. A nil fn stops
+// tracing.
+func (c *Client) SetTracer(fn func(dir Direction, stanza []byte)) {
+	c.traceOnce.Do(func() { go c.runTracer() })
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tracer = fn
+	if c.connection == nil {
+		return
+	}
+	if fn == nil {
+		c.connection.SetTracer(nil)
+	} else {
+		c.connection.SetTracer(c.trace)
+	}
 }
 
-// Join accepts the room id and the name used to display the client in the
-// room.
-func (c *Client) Join(roomId, resource string) {
-	c.connection.MUCPresence(roomId+"/"+resource, c.Id)
+func (c *Client) trace(dir xmpp.Direction, stanza []byte) {
+	d := Inbound
+	if dir == xmpp.Outbound {
+		d = Outbound
+	}
+	select {
+	case c.traces <- trace{d, stanza}:
+	default:
+	}
 }
 
-// Say accepts a room id, the name of the client in the room, and the message
-// body and sends the message to the HipChat room.
-func (c *Client) Say(to, name, body string) {
-	if strings.Contains(to, conf) {
-		c.connection.MUCSend(to, c.Id+"/"+name, body)
-	} else {
-		c.connection.Send(to, c.Id+"/"+name, body)
+func (c *Client) runTracer() {
+	for {
+		select {
+		case t := <-c.traces:
+			c.mu.Lock()
+			fn := c.tracer
+			c.mu.Unlock()
+			if fn != nil {
+				fn(t.dir, t.stanza)
+			}
+		case <-c.done:
+			return
+		}
 	}
 }
 
-// KeepAlive is meant to run as a goroutine. It sends a single whitespace
-// character to HipChat every 60 seconds. This keeps the connection from
-// idling after 150 seconds.
-func (c *Client) KeepAlive() {
-	for _ = range time.Tick(60 * time.Second) {
-		c.connection.KeepAlive()
+// Handshake returns the steps the handshake of the current connection took,
+// or of the last attempt if connecting failed.
+func (c *Client) Handshake() HandshakeTrace {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append(HandshakeTrace{}, c.handshake...)
+}
+
+// step records a step of the handshake.
+func (c *Client) step(step, detail string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handshake = append(c.handshake, HandshakeStep{Step: step, Detail: detail, Time: time.Now()})
+}
+
+// ConnectionInfo returns a snapshot of the state of the connection.
+func (c *Client) ConnectionInfo() ConnectionInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	info := ConnectionInfo{
+		Connected:    c.connected,
+		FullJID:      c.fullJID,
+		LastPing:     c.lastPing,
+		Reconnects:   c.reconnects,
+		BytesRead:    c.bytesRead,
+		BytesWritten: c.bytesWritten,
 	}
+	if c.connection != nil {
+		info.BytesRead += c.connection.BytesRead()
+		info.BytesWritten += c.connection.BytesWritten()
+		if state, ok := c.connection.TLSState(); ok {
+			info.TLS = true
+			info.TLSVersion = state.Version
+			info.CipherSuite = state.CipherSuite
+		}
+	}
+	return info
 }
 
-func (c *Client) requestRooms() {
-	c.connection.Discover(c.Id, conf)
+// IsSecure reports whether the client is connected over TLS. It is false
+// while the client is not connected and, with WithDisableTLS, over a cleartext
+// connection; without that option the client never falls back to cleartext.
+// ConnectionInfo gives the negotiated version and cipher suite.
+func (c *Client) IsSecure() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.connected || c.connection == nil {
+		return false
+	}
+	_, ok := c.connection.TLSState()
+	return ok
 }
 
-func (c *Client) requestUsers() {
-	c.connection.Roster(c.Id, host)
+// Ready returns a channel that is closed once the client is fully set up: it
+// has connected, fetched its roster and joined the rooms given with WithJoin.
+// Unlike OnConnect, it is not signalled again after reconnecting. If a room
+// refuses the join, or does not confirm it within the request timeout (see
+// WithRequestTimeout), the channel is never closed.
+func (c *Client) Ready() <-chan struct{} {
+	return c.ready
 }
 
-func (c *Client) authenticate() error {
-	c.connection.Stream(c.Id, host)
-	for {
-		element, err := c.connection.Next()
-		if err != nil {
-			return err
+// WaitForRoster blocks until the roster fetched on connecting has been
+// received, so that MentionName and the mention names of messages can be
+// resolved, and returns nil. Ready waits for it too. It returns ctx.Err() if
+// ctx is done first, ErrNotConnected if the client is disconnected first, and
+// ErrNotSupported for anonymous clients, which do not fetch a roster.
+func (c *Client) WaitForRoster(ctx context.Context) error {
+	if c.config.anonymous {
+		return ErrNotSupported
+	}
+	select {
+	case <-c.rosterFetched:
+		return nil
+	case <-c.done:
+		return ErrNotConnected
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// initialize joins the rooms given with WithJoin once the roster has been
+// fetched and then closes ready.
+func (c *Client) initialize() {
+	if !c.config.anonymous {
+		select {
+		case <-c.rosterFetched:
+		case <-c.done:
+			return
 		}
+	}
 
-		switch element.Name.Local + element.Name.Space {
-		case "stream" + xmpp.NsStream:
-			features := c.connection.Features()
-			if features.StartTLS != nil {
-				c.connection.StartTLS()
-			} else {
-				for _, m := range features.Mechanisms {
-					if m == "PLAIN" {
-						c.connection.Auth(c.Username, c.Password, c.Resource)
-					}
-				}
-			}
-		case "proceed" + xmpp.NsTLS:
-			c.connection.UseTLS()
-			c.connection.Stream(c.Id, host)
-		case "iq" + xmpp.NsJabberClient:
-			for _, attr := range element.Attr {
-				if attr.Name.Local == "type" && attr.Value == "result" {
-					return nil // authenticated
-				}
-			}
+	for _, r := range c.config.rooms {
+		if err := c.JoinSync(r.RoomId, r.Nick, c.config.requestTimeout); err != nil {
+			c.log("Unable to join room:", r.RoomId, err)
+			return
+		}
+	}
+	close(c.ready)
+}
 
-			return errors.New("could not authenticate")
+// OnConnect returns a read-only channel of booleans and sends true
+// when ever the client connects or reconnects. Notifications that do not fit
+// in the channel's buffer are dropped.
+func (c *Client) OnConnect() <-chan bool {
+	return c.onConnect
+}
+
+// OnReconnect returns a read-only channel of ReconnectInfo structs, sent
+// whenever the client reconnects after losing its connection. The initial
+// connect is only reported on OnConnect. Notifications that do not fit in the
+// channel's buffer are dropped.
+func (c *Client) OnReconnect() <-chan ReconnectInfo {
+	return c.onReconnect
+}
+
+// Messages returns a read-only channel of Message structs. After joining a
+// room, messages will be sent on the channel.
+//
+// Delivery is lossy: messages are buffered (see WithMessageBuffer) and
+// dropped when the buffer is full, so a slow consumer never stalls the
+// connection. Earlier versions blocked the connection until every message was
+// read instead. Applications that must not lose messages should read the
+// channel promptly or use a larger buffer, and can tell whether messages were
+// lost from Stats.
+func (c *Client) Messages() <-chan *Message {
+	return c.receivedMessage
+}
+
+// SearchRoom returns up to limit of the messages kept for a room whose body
+// contains substring, ignoring case, newest first. A limit of zero or less
+// returns every match. Messages are only kept with WithRoomHistory.
+func (c *Client) SearchRoom(roomId, substring string, limit int) []*Message {
+	substring = strings.ToLower(substring)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var found []*Message
+	history := c.history[roomId]
+	for i := len(history) - 1; i >= 0; i-- {
+		if limit > 0 && len(found) == limit {
+			break
+		}
+		if strings.Contains(strings.ToLower(history[i].Body), substring) {
+			found = append(found, history[i])
 		}
 	}
+	return found
+}
 
-	return errors.New("unexpectedly ended auth loop")
+// Pause stops delivering messages on Messages until Resume is called. The
+// connection is still read, so requests and everything else go on as usual,
+// and received messages are held back, up to the limit set with
+// WithPauseBuffer; messages beyond it are dropped.
+func (c *Client) Pause() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paused = true
 }
 
-func (c *Client) listen() {
+// Resume delivers the messages held back since Pause, in order, and then
+// carries on delivering new messages. Unlike other messages, held back
+// messages wait for room on the Messages channel rather than being dropped.
+func (c *Client) Resume() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paused = false
+	if c.flushing || c.closed() {
+		return
+	}
+	c.flushing = true
+	c.flusher.Add(1)
+	go c.flush()
+}
+
+// flush delivers the held back messages until there are none left or
+// delivery is paused again.
+func (c *Client) flush() {
+	defer c.flusher.Done()
 	for {
-		element, err := c.connection.Next()
-		if err != nil {
-			for m := 0; m < 5; m++ {
-				for i := 1; i < 11; i++ {
-					time.Sleep(time.Duration(i) * time.Second)
-					err = c.connect()
-					if err == nil {
-						goto Reconnected
-					} else {
-						fmt.Println("Unable to connect err:", err)
-					}
-				}
-				time.Sleep(time.Duration(m) * time.Minute)
-			}
-			panic(err)
-		Reconnected:
-			continue
+		c.mu.Lock()
+		if c.paused || len(c.held) == 0 {
+			c.flushing = false
+			c.mu.Unlock()
+			return
 		}
+		m := c.held[0]
+		c.held = c.held[1:]
+		c.mu.Unlock()
 
-		switch element.Name.Local + element.Name.Space {
-		case "iq" + xmpp.NsJabberClient: // rooms and rosters
-			//attr := xmpp.ToMap(element.Attr)
-			query := c.connection.Query()
-			//fmt.Printf("<%v: %#v\n>%v\n\n", element.Name.Local, attr, query)
-			switch query.XMLName.Space {
-			case xmpp.NsDisco:
-				items := make([]*Room, len(query.Items))
-				for i, item := range query.Items {
-					items[i] = &Room{Id: item.Jid, Name: item.Name}
-				}
-				c.receivedRooms <- items
-			case xmpp.NsIqRoster:
-				items := make([]*User, len(query.Items))
-				for i, item := range query.Items {
-					items[i] = &User{Id: item.Jid, Name: item.Name, MentionName: item.MentionName}
-				}
-				c.receivedUsers <- items
-			}
-		case "presence" + xmpp.NsJabberClient:
-			//attr := xmpp.ToMap(element.Attr)
-			//body := c.connection.Body()
-			//fmt.Printf("<%v: %#v\n>%v\n\n", element.Name.Local, attr, body)
-		case "message" + xmpp.NsJabberClient:
-			attr := xmpp.ToMap(element.Attr)
-			if attr["type"] != "groupchat" && attr["type"] != "chat" {
-				continue
-			}
+		select {
+		case c.receivedMessage <- m:
+		case <-c.done:
+			return
+		}
+	}
+}
 
-			// empty body indicates a toggle in typing status
-			body := c.connection.Body()
-			//fmt.Printf("<%v: %#v\n>%v\n\n", element.Name.Local, attr, body)
-			if len(body) == 0 {
-				continue
+// MessagesContext returns a read-only channel that receives the same messages
+// as Messages until ctx is done, at which point the channel is closed. It lets
+// a consumer stop ranging over messages without tearing down the Client. The
+// channel is buffered like Messages and drops messages when full.
+func (c *Client) MessagesContext(ctx context.Context) <-chan *Message {
+	ch := make(chan *Message, c.config.messageBuffer)
+	c.mu.Lock()
+	c.subscribers[ch] = true
+	c.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		c.mu.Lock()
+		delete(c.subscribers, ch)
+		close(ch)
+		c.mu.Unlock()
+	}()
+	return ch
+}
+
+// Commands returns a read-only channel of the received messages that are
+// commands starting with prefix, parsed as by ParseCommand. The client's own
+// messages are left out. Each call returns a new channel, which is closed when
+// the client is disconnected. Commands are dropped if the channel is full.
+func (c *Client) Commands(prefix string) <-chan *Command {
+	commands := make(chan *Command, c.config.messageBuffer)
+	c.addHandler(func(m *Message) {
+		if m.IsOwn {
+			return
+		}
+		if cmd := ParseCommand(prefix, m); cmd != nil {
+			select {
+			case commands <- cmd:
+			default:
+				drops := atomic.AddInt64(&c.commandDrops, 1)
+				c.log("WARNING: Commands channel is full, dropped", describeMessage(m)+"; total dropped:", drops)
 			}
+		}
+	}, func() { close(commands) })
+	return commands
+}
+
+// MuteRoom drops the messages received in a room instead of delivering them
+// on Messages, Mentions, MessagesContext channels and OnMessage handlers,
+// without leaving the room. Mutes last until undone, across reconnects.
+func (c *Client) MuteRoom(roomId string) {
+	c.mute(bareJID(roomId), true)
+}
+
+// UnmuteRoom delivers the messages received in a room again.
+func (c *Client) UnmuteRoom(roomId string) {
+	c.mute(bareJID(roomId), false)
+}
 
-			c.receivedMessage <- &Message{
-				ID:   attr["mid"],
-				Type: attr["type"],
-				From: attr["from"],
-				To:   attr["to"],
-				Body: body,
+// MuteUser drops the messages received from a user, in chats and in rooms, as
+// MuteRoom does for a room. In rooms that do not reveal who their occupants
+// are the user's messages cannot be recognized and are still delivered.
+func (c *Client) MuteUser(jid string) {
+	c.mute(bareJID(jid), true)
+}
+
+// UnmuteUser delivers the messages received from a user again.
+func (c *Client) UnmuteUser(jid string) {
+	c.mute(bareJID(jid), false)
+}
+
+// Muted reports whether the room or user with the given id is muted.
+func (c *Client) Muted(jid string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.muted[bareJID(jid)]
+}
+
+func (c *Client) mute(jid string, muted bool) {
+	if jid == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if muted {
+		c.muted[jid] = true
+	} else {
+		delete(c.muted, jid)
+	}
+}
+
+// OnMessage registers fn to be called with every message received, in the
+// order they were received. Each handler runs in its own goroutine with its
+// own queue, so a slow handler holds up neither the others nor the
+// connection; when its queue is full, messages for it are dropped and counted
+// in HandlerDrops. Handlers stop when the client is disconnected.
+func (c *Client) OnMessage(fn func(*Message)) {
+	c.addHandler(fn, nil)
+}
+
+// addHandler registers fn like OnMessage and calls stopped, if not nil, once
+// the handler has stopped.
+func (c *Client) addHandler(fn func(*Message), stopped func()) {
+	queue := make(chan *Message, c.config.handlerBuffer)
+	c.mu.Lock()
+	c.handlers = append(c.handlers, queue)
+	c.mu.Unlock()
+
+	go func() {
+		if stopped != nil {
+			defer stopped()
+		}
+		for {
+			select {
+			case m := <-queue:
+				fn(m)
+			case <-c.done:
+				return
 			}
 		}
+	}()
+}
+
+// HandlerDrops returns the number of messages dropped because a handler
+// registered with OnMessage had a full queue.
+func (c *Client) HandlerDrops() int64 {
+	return atomic.LoadInt64(&c.handlerDrops)
+}
+
+// Stats returns the number of received messages dropped so far, see Stats.
+func (c *Client) Stats() Stats {
+	return Stats{
+		MessageDrops: atomic.LoadInt64(&c.messageDrops),
+		HandlerDrops: atomic.LoadInt64(&c.handlerDrops),
+		HeldDrops:    atomic.LoadInt64(&c.heldDrops),
+		ContextDrops: atomic.LoadInt64(&c.contextDrops),
+		CommandDrops: atomic.LoadInt64(&c.commandDrops),
+		MentionDrops: atomic.LoadInt64(&c.mentionDrops),
+	}
+}
+
+// Mentions returns a read-only channel of Message structs for messages that
+// @mention the client by its mention name, @all or @here. Mentions are matched
+// case-insensitively on word boundaries. The client's own messages are left
+// out. Every mention is also sent on the Messages channel. Mentions are
+// dropped if the channel is full.
+func (c *Client) Mentions() <-chan *Message {
+	return c.mentions
+}
+
+// SystemMessages returns a read-only channel of Message structs for headline
+// and normal messages, which HipChat uses for system notices. Their Type is
+// "headline" or "normal", which messages without a type default to. They are
+// not sent on Messages. Messages are dropped if the channel is full.
+func (c *Client) SystemMessages() <-chan *Message {
+	return c.systemMessages
+}
+
+// MessageErrors returns a read-only channel of Message structs for error
+// messages, which HipChat sends when a message could not be delivered, such as
+// a direct message to a user who is offline ("service-unavailable" or
+// "recipient-unavailable") or has blocked the client ("forbidden"). The
+// message's Error describes the failure and its ID is the id SayWithID
+// returned for the message that bounced. Errors are dropped if the channel is
+// full.
+func (c *Client) MessageErrors() <-chan *Message {
+	return c.messageErrors
+}
+
+// Subscriptions returns a read-only channel of Subscription structs for the
+// presence subscription requests and answers the client receives. Events are
+// dropped if the channel is full.
+func (c *Client) Subscriptions() <-chan *Subscription {
+	return c.subscriptions
+}
+
+// Subscribe asks to receive the presence of the user with the given JID. The
+// answer arrives on Subscriptions. HipChat manages most of the roster itself
+// and may refuse.
+func (c *Client) Subscribe(jid string) error {
+	return c.subscription(jid, "subscribe")
+}
+
+// Unsubscribe stops receiving the presence of the user with the given JID.
+func (c *Client) Unsubscribe(jid string) error {
+	return c.subscription(jid, "unsubscribe")
+}
+
+// ApproveSubscription lets the user with the given JID, who asked to on
+// Subscriptions, receive the client's presence.
+func (c *Client) ApproveSubscription(jid string) error {
+	return c.subscription(jid, "subscribed")
+}
+
+// DenySubscription refuses, or revokes, the user's subscription to the
+// client's presence.
+func (c *Client) DenySubscription(jid string) error {
+	return c.subscription(jid, "unsubscribed")
+}
+
+func (c *Client) subscription(jid, typ string) error {
+	return c.write(func(conn *xmpp.Conn) error {
+		return conn.Subscription(c.JID(), bareJID(jid), typ)
+	})
+}
+
+// RoomStates returns a read-only channel of RoomState structs, sent whenever
+// someone enters or leaves a joined room or its topic changes. Events are
+// dropped if the channel is full.
+func (c *Client) RoomStates() <-chan *RoomState {
+	return c.roomStates
+}
+
+// OccupantEvents returns a read-only channel of people joining and leaving the
+// rooms the client is in. Leaving is only reported once the debounce set with
+// WithOccupantDebounce has passed without the occupant coming back, so that
+// someone whose client reconnects is not reported at all. The occupants
+// already in a room when the client joins or rejoins it are not reported, nor
+// are those who left while the client was reconnecting. Events are dropped if
+// the channel is full.
+func (c *Client) OccupantEvents() <-chan *OccupantEvent {
+	return c.occupantEvents
+}
+
+// Markers returns a read-only channel of chat markers received from other
+// users. Markers are dropped if the channel is full.
+func (c *Client) Markers() <-chan *Marker {
+	return c.markers
+}
+
+// MarkReceived tells the sender of the message with the given id that it was
+// received. Markers are only sent automatically as set with
+// WithAckPolicy.
+func (c *Client) MarkReceived(to, id string) error {
+	return c.mark(to, "received", id)
+}
+
+// MarkDisplayed tells the sender of the message with the given id, and of all
+// the messages before it, that it has been seen.
+func (c *Client) MarkDisplayed(to, id string) error {
+	return c.mark(to, "displayed", id)
+}
+
+func (c *Client) mark(to, marker, id string) error {
+	typ := "chat"
+	if c.isRoom(to) {
+		typ = "groupchat"
+		to = bareJID(to)
+	}
+	return c.write(func(conn *xmpp.Conn) error {
+		return conn.Marker(typ, to, c.JID(), marker, id)
+	})
+}
+
+// RosterUpdates returns a read-only channel of RosterUpdate structs. HipChat
+// pushes an update whenever a user is added to, removed from or renamed in the
+// roster. Updates are dropped if the channel is not being read.
+func (c *Client) RosterUpdates() <-chan *RosterUpdate {
+	return c.rosterUpdates
+}
+
+// Rooms returns an slice of Room structs. It gives up after the request
+// timeout (see WithRequestTimeout) and returns context.DeadlineExceeded. A
+// successful request returns a non-nil slice, even if it is empty.
+func (c *Client) Rooms() ([]*Room, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.config.requestTimeout)
+	defer cancel()
+	return c.RoomsContext(ctx)
+}
+
+// RoomsContext returns a slice of Room structs, or ctx.Err() if ctx is done
+// before HipChat replies. The reply does not wait behind received messages, so
+// it is safe to call while messages are not being read. If the conference
+// domain refuses to list its rooms, the *StanzaError it replied with is
+// returned, or ErrNotSupported if it does not implement listing at all; an
+// empty slice and a nil error mean there are no rooms to list.
+func (c *Client) RoomsContext(ctx context.Context) ([]*Room, error) {
+	iq, err := c.request(ctx, func(conn *xmpp.Conn, id string) error {
+		return conn.Discover(id, c.JID(), c.config.confDomain)
+	})
+	if e, ok := err.(*StanzaError); ok && e.Condition == "feature-not-implemented" {
+		return nil, ErrNotSupported
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rooms := []*Room{}
+	if iq.Query != nil {
+		for _, item := range iq.Query.Items {
+			rooms = append(rooms, &Room{Id: item.Jid, Name: item.Name})
+		}
+	}
+	return rooms, nil
+}
+
+// DiscoInfo asks jid, a room or server, what it is and which features it
+// supports. It gives up after the request timeout (see WithRequestTimeout)
+// and returns context.DeadlineExceeded.
+func (c *Client) DiscoInfo(jid string) (*DiscoInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.config.requestTimeout)
+	defer cancel()
+	return c.DiscoInfoContext(ctx, jid)
+}
+
+// DiscoInfoContext works like DiscoInfo, but returns ctx.Err() if ctx is done
+// before jid replies.
+func (c *Client) DiscoInfoContext(ctx context.Context, jid string) (*DiscoInfo, error) {
+	iq, err := c.request(ctx, func(conn *xmpp.Conn, id string) error {
+		return conn.DiscoInfo(id, c.JID(), jid)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	info := &DiscoInfo{Identities: []Identity{}, Features: []string{}}
+	if iq.Query != nil {
+		for _, i := range iq.Query.Identities {
+			info.Identities = append(info.Identities, Identity{Category: i.Category, Type: i.Type, Name: i.Name})
+		}
+		for _, f := range iq.Query.Features {
+			info.Features = append(info.Features, f.Var)
+		}
+	}
+	return info, nil
+}
+
+// ServerCapabilities returns the features the server supports, as advertised
+// with entity capabilities (XEP-0115) in its stream features or presence. The
+// client resolves them with disco#info after connecting, and again only when
+// the server advertises a set of features it has not seen, so checking them
+// costs nothing. It returns nil until they have been resolved, and if the
+// server does not advertise its capabilities; DiscoInfo on the server's
+// domain asks for its features directly.
+func (c *Client) ServerCapabilities() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.serverCaps == nil {
+		return nil
+	}
+	features, ok := c.capsCache[c.serverCaps.Ver]
+	if !ok {
+		return nil
+	}
+	return append([]string(nil), features...)
+}
+
+// resolveServerCaps asks the server for the features caps stand for, unless
+// they are cached already.
+func (c *Client) resolveServerCaps(caps *xmpp.Caps) {
+	c.mu.Lock()
+	_, ok := c.capsCache[caps.Ver]
+	c.mu.Unlock()
+	if ok || caps.Ver == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.config.requestTimeout)
+	defer cancel()
+	iq, err := c.request(ctx, func(conn *xmpp.Conn, id string) error {
+		return conn.DiscoInfoNode(id, c.JID(), c.config.xmppDomain, caps.Node+"#"+caps.Ver)
+	})
+	if err != nil {
+		c.log("Unable to resolve server capabilities err:", err)
+		return
+	}
+
+	features := []string{}
+	if iq.Query != nil {
+		for _, f := range iq.Query.Features {
+			features = append(features, f.Var)
+		}
+	}
+	c.mu.Lock()
+	c.capsCache[caps.Ver] = features
+	c.mu.Unlock()
+}
+
+// LastActivity returns how long the user with the given JID has been idle
+// (XEP-0012). It returns ErrNotSupported if neither the user's client nor the
+// server answer such queries, and gives up after the request timeout (see
+// WithRequestTimeout).
+func (c *Client) LastActivity(jid string) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.config.requestTimeout)
+	defer cancel()
+	return c.LastActivityContext(ctx, jid)
+}
+
+// LastActivityContext works like LastActivity, but returns ctx.Err() if ctx is
+// done before jid replies.
+func (c *Client) LastActivityContext(ctx context.Context, jid string) (time.Duration, error) {
+	iq, err := c.request(ctx, func(conn *xmpp.Conn, id string) error {
+		return conn.LastActivity(id, c.JID(), jid)
+	})
+	if e, ok := err.(*StanzaError); ok && (e.Condition == "feature-not-implemented" || e.Condition == "service-unavailable") {
+		return 0, ErrNotSupported
+	}
+	if err != nil {
+		return 0, err
+	}
+	if iq.Query == nil {
+		return 0, ErrNotSupported
+	}
+	return time.Duration(iq.Query.Seconds) * time.Second, nil
+}
+
+// Users returns a slice of User structs. It gives up after the request timeout
+// (see WithRequestTimeout) and returns context.DeadlineExceeded. A successful
+// request returns a non-nil slice, even if it is empty.
+func (c *Client) Users() ([]*User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.config.requestTimeout)
+	defer cancel()
+	return c.UsersContext(ctx)
+}
+
+// UsersContext returns a slice of User structs, or ctx.Err() if ctx is done
+// before HipChat replies. The reply does not wait behind received messages, so
+// it is safe to call while messages are not being read.
+func (c *Client) UsersContext(ctx context.Context) ([]*User, error) {
+	iq, err := c.request(ctx, func(conn *xmpp.Conn, id string) error {
+		return conn.Roster(id, c.JID(), c.config.xmppDomain)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	users := []*User{}
+	if iq.Query != nil {
+		for _, item := range iq.Query.Items {
+			users = append(users, newUser(item.Jid, item.Name, item.MentionName, item.Subscription, item.Groups))
+		}
+	}
+	c.updateMentionNames(users)
+	return users, nil
+}
+
+// userStreamBuffer is the number of users StreamUsers holds for a caller that
+// is not reading them before the client stops receiving until it does.
+const userStreamBuffer = 256
+
+// StreamUsers fetches the roster like UsersContext, but sends each user on
+// users as soon as it is decoded instead of collecting them, so that a bot in
+// a large organization can start resolving names before the whole roster has
+// arrived and without holding it in memory. HipChat sends the roster in a
+// single stanza, however many reads it takes to arrive. It returns once the
+// roster is complete and every user has been sent, ctx.Err() if ctx is done
+// first, or the error HipChat replied with. Up to 256 users wait for users to
+// be read; beyond that, received messages wait too, so it should be read
+// promptly.
+func (c *Client) StreamUsers(ctx context.Context, users chan<- *User) error {
+	conn, err := c.conn()
+	if err != nil {
+		return err
+	}
+
+	// the listener queues the users, blocking once the queue is full, and
+	// a separate goroutine sends them on users
+	queue := make(chan *User, userStreamBuffer)
+	stop := make(chan struct{})
+	each := func(u *User) {
+		select {
+		case queue <- u:
+		case <-stop:
+		case <-ctx.Done():
+		}
+	}
+	sent := make(chan bool, 1) // whether every user was sent
+	go func() {
+		for {
+			select {
+			case u, ok := <-queue:
+				if !ok {
+					sent <- true
+					return
+				}
+				select {
+				case users <- u:
+				case <-stop:
+					sent <- false
+					return
+				case <-ctx.Done():
+					sent <- false
+					return
+				}
+			case <-stop:
+				sent <- false
+				return
+			}
+		}
+	}()
+
+	// registered before the request is sent, so the reply cannot be decoded
+	// first
+	id := conn.NewID()
+	c.mu.Lock()
+	c.rosterStreams[id] = each
+	c.mu.Unlock()
+	_, err = c.requestID(ctx, id, func(conn *xmpp.Conn, id string) error {
+		return conn.Roster(id, c.JID(), c.config.xmppDomain)
+	})
+	c.mu.Lock()
+	delete(c.rosterStreams, id)
+	c.mu.Unlock()
+	if err != nil {
+		// the listener may still be decoding the roster
+		close(stop)
+		return err
+	}
+
+	// the reply has been decoded, so nothing more is queued
+	close(queue)
+	if !<-sent {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// rosterStream returns the function receiving the users of the roster in the
+// iq that begins with element, or nil if it is not streamed.
+func (c *Client) rosterStream(element xml.StartElement) func(*User) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, attr := range element.Attr {
+		if attr.Name.Local == "id" {
+			each := c.rosterStreams[attr.Value]
+			delete(c.rosterStreams, attr.Value)
+			return each
+		}
+	}
+	return nil
+}
+
+// Ping sends an XMPP ping (XEP-0199) to target and returns the round trip time.
+// An empty target pings the HipChat server.
+func (c *Client) Ping(ctx context.Context, target string) (time.Duration, error) {
+	if target == "" {
+		target = c.config.xmppDomain
+	}
+
+	from := c.FullJID()
+	start := time.Now()
+	_, err := c.request(ctx, func(conn *xmpp.Conn, id string) error {
+		return conn.Ping(id, from, target)
+	})
+	if err != nil {
+		return 0, err
+	}
+	rtt := time.Since(start)
+
+	c.mu.Lock()
+	c.lastPing = rtt
+	c.mu.Unlock()
+	return rtt, nil
+}
+
+// Status sends a string to HipChat to indicate whether the client is available
+// to chat, away or idle. It returns ErrNotConnected while the client is not
+// connected, or the error writing the presence.
+func (c *Client) Status(s string) error {
+	return c.write(func(conn *xmpp.Conn) error {
+		c.setPresence(s, "")
+		return conn.Presence(c.JID(), s)
+	})
+}
+
+// setPresence records the presence last sent, ending any do not disturb
+// window set with SetDND.
+func (c *Client) setPresence(show, text string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.presence = &status{show: show, text: text}
+	c.stopDND()
+}
+
+// sendPresence sends the given presence, with its status text if it has one.
+func (c *Client) sendPresence(conn *xmpp.Conn, p *status) error {
+	if p.text == "" {
+		return conn.Presence(c.JID(), p.show)
+	}
+	return conn.Status(c.JID(), p.show, p.text)
+}
+
+// SetDND sets the client's availability to do not disturb ("dnd") with the
+// given status text until the given time, when the presence the client had
+// before is restored. If the client reconnects within the window, it is sent
+// do not disturb again, in place of the presence given to
+// WithPresenceOnConnect. Calling SetDND again moves the end of the window, and
+// calling Status or SetCustomStatus ends it early with their presence. It
+// returns ErrNotConnected while the client is not connected, or the error
+// writing the presence.
+func (c *Client) SetDND(statusText string, until time.Time) error {
+	return c.write(func(conn *xmpp.Conn) error {
+		c.mu.Lock()
+		if c.dnd == nil {
+			c.dndPrior = c.presence
+		}
+		c.stopDND()
+		c.dndWindow++
+		window := c.dndWindow
+		c.dnd = time.AfterFunc(time.Until(until), func() { c.endDND(window) })
+		c.presence = &status{show: "dnd", text: statusText}
+		c.mu.Unlock()
+
+		return conn.Status(c.JID(), "dnd", statusText)
+	})
+}
+
+// stopDND stops the timer ending the do not disturb window, if one is set.
+// c.mu must be held.
+func (c *Client) stopDND() {
+	if c.dnd == nil {
+		return
+	}
+	c.dnd.Stop()
+	c.dnd = nil
+	c.dndWindow++
+}
+
+// endDND restores the presence the client had before SetDND, unless the
+// window has since been moved or ended.
+func (c *Client) endDND(window int) {
+	c.mu.Lock()
+	if c.dnd == nil || c.dndWindow != window {
+		c.mu.Unlock()
+		return
+	}
+	c.dnd = nil
+	c.presence = c.dndPrior
+	c.dndPrior = nil
+	prior := c.presence
+	connected := c.connected
+	conn := c.connection
+	c.mu.Unlock()
+
+	if !connected {
+		// the restored presence is sent on reconnecting
+		return
+	}
+	if prior == nil {
+		prior = &status{show: "chat"}
+	}
+	c.sendPresence(conn, prior)
+}
+
+// SetCustomStatus sets the client's availability, as for Status, along with a
+// status text and an emoji, given as the name of a HipChat emoticon such as
+// "coffee". HipChat's own clients keep the emoji in a proprietary extension
+// that is not available over XMPP, so it is sent as an emoticon shortcut at
+// the start of the status text, "(coffee) On a break", which HipChat renders
+// as the emoticon. Either text or emoji may be empty.
+func (c *Client) SetCustomStatus(show, text, emoji string) error {
+	if emoji != "" {
+		text = strings.TrimSpace("(" + emoji + ") " + text)
+	}
+	return c.write(func(conn *xmpp.Conn) error {
+		c.setPresence(show, text)
+		return conn.Status(c.JID(), show, text)
+	})
+}
+
+// SetRoomPresence sets the client's availability and status text in a single
+// joined room, under the name it joined with, without changing its presence
+// anywhere else. Presence refreshes keep it, but joining the room again, as
+// reconnects do, resets it.
+func (c *Client) SetRoomPresence(roomId, resource, show, statusText string) error {
+	err := c.write(func(conn *xmpp.Conn) error {
+		return conn.MUCStatus(roomId+"/"+resource, c.JID(), show, statusText)
+	})
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.roomPresence[roomId] = status{show: show, text: statusText}
+	c.mu.Unlock()
+	return nil
+}
+
+// Join accepts the room id and the name used to display the client in the
+// room. It returns ErrNotConnected while the client is not connected, or the
+// error writing the presence.
+//
+// There is no way to join a room silently. MUC has no flag for it, and the
+// notice other occupants see is their client's rendering of the presence the
+// room broadcasts to them, which a room must send for every occupant. Joining
+// rooms once and staying in them, with WithPresenceRefresh if the room drops
+// idle occupants, keeps the notices down.
+func (c *Client) Join(roomId, resource string) error {
+	err := c.write(func(conn *xmpp.Conn) error {
+		if since := c.storedLastSeen(roomId); !since.IsZero() {
+			maxStanzas := -1
+			if c.config.replayMissed > 0 {
+				maxStanzas = c.config.replayMissed
+			}
+			return conn.MUCJoin(roomId+"/"+resource, c.JID(), "", maxStanzas, since)
+		}
+		return conn.MUCPresence(roomId+"/"+resource, c.JID())
+	})
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.joined[roomId] = resource
+	delete(c.passwords, roomId)
+	delete(c.refused, roomId)
+	delete(c.roomPresence, roomId)
+	c.mu.Unlock()
+	return nil
+}
+
+// storedLastSeen returns the time of the last message seen in a room before
+// the process started, from the Store set with WithStore, if the room has not
+// been joined since. Otherwise it returns the zero time.
+func (c *Client) storedLastSeen(roomId string) time.Time {
+	if c.config.store == nil {
+		return time.Time{}
+	}
+	c.mu.Lock()
+	_, known := c.lastSeen[roomId]
+	c.mu.Unlock()
+	if known {
+		return time.Time{}
+	}
+
+	t, err := c.config.store.Load(roomId)
+	if err != nil {
+		c.log("Unable to load last seen message time:", roomId, err)
+		return time.Time{}
+	}
+	c.mu.Lock()
+	if _, known := c.lastSeen[roomId]; !known {
+		c.lastSeen[roomId] = t
+	}
+	c.mu.Unlock()
+	return t
+}
+
+// JoinRoom joins room like Join, using its Id.
+func (c *Client) JoinRoom(room *Room, resource string) error {
+	if room == nil || room.Id == "" {
+		return ErrInvalidRoom
+	}
+	return c.Join(room.Id, resource)
+}
+
+// Leave leaves a room the client joined under the name resource, so it is no
+// longer rejoined on reconnecting. It returns ErrNotConnected while the client
+// is not connected, or the error writing the presence.
+func (c *Client) Leave(roomId, resource string) error {
+	err := c.write(func(conn *xmpp.Conn) error {
+		return conn.MUCPart(roomId+"/"+resource, c.JID())
+	})
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	delete(c.joined, roomId)
+	delete(c.passwords, roomId)
+	delete(c.joinCodes, roomId)
+	delete(c.occupants, roomId)
+	delete(c.entered, roomId)
+	delete(c.refused, roomId)
+	c.cancelLeaves(roomId)
+	delete(c.topics, roomId)
+	delete(c.topicSetters, roomId)
+	delete(c.roomPresence, roomId)
+	c.mu.Unlock()
+	return nil
+}
+
+// LeaveRoom leaves room like Leave, using its Id.
+func (c *Client) LeaveRoom(room *Room, resource string) error {
+	if room == nil || room.Id == "" {
+		return ErrInvalidRoom
+	}
+	return c.Leave(room.Id, resource)
+}
+
+// JoinSync joins a room like Join, but waits until the room confirms the
+// client has entered it, so that messages said to the room straight after are
+// not lost. It returns a *StanzaError if the room refuses the join and
+// context.DeadlineExceeded if no confirmation arrives within timeout. The
+// status codes of the confirmation are available from JoinCodes.
+func (c *Client) JoinSync(roomId, resource string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	ch := make(chan error, 1)
+	c.mu.Lock()
+	c.joining[roomId] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		if c.joining[roomId] == ch {
+			delete(c.joining, roomId)
+		}
+		c.mu.Unlock()
+	}()
+
+	if err := c.Join(roomId, resource); err != nil {
+		return err
+	}
+
+	select {
+	case err := <-ch:
+		if err != nil {
+			c.mu.Lock()
+			delete(c.joined, roomId)
+			c.mu.Unlock()
+		}
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// MUC status codes HipChat sends when confirming a join, see JoinCodes.
+const (
+	StatusNonAnonymous = 100 // occupants can see each other's real JIDs
+	StatusSelf         = 110 // the presence is the client's own
+	StatusLogging      = 170 // the room is logged
+	StatusRoomCreated  = 201 // the join created the room
+)
+
+// JoinCodes returns the MUC status codes, such as StatusLogging, the room sent
+// when it last confirmed the client joining it. It returns ErrNotJoined if the
+// client has not joined the room and ErrNotConfirmed if the room has not
+// confirmed yet.
+func (c *Client) JoinCodes(roomId string) ([]int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.joined[roomId]; !ok {
+		return nil, ErrNotJoined
+	}
+	codes, ok := c.joinCodes[roomId]
+	if !ok {
+		return nil, ErrNotConfirmed
+	}
+	return append([]int{}, codes...), nil
+}
+
+// A JoinState describes how far joining a room has got, see Client.JoinState.
+type JoinState int
+
+const (
+	JoinPending   JoinState = iota // the room has not answered yet
+	JoinConfirmed                  // the room confirmed the client entered it
+	JoinRefused                    // the room refused the client
+)
+
+func (s JoinState) String() string {
+	switch s {
+	case JoinConfirmed:
+		return "confirmed"
+	case JoinRefused:
+		return "refused"
+	}
+	return "pending"
+}
+
+// JoinState reports whether a room the client joined has confirmed the join,
+// for finding out why no messages arrive from it. A refused join comes with
+// the *StanzaError the room refused it with. The state is pending again while
+// the client rejoins after reconnecting. It returns ErrNotJoined if the client
+// has not joined the room. If the join is confirmed but messages are still
+// missing, they are most likely being dropped because Messages is not read;
+// the client logs each drop, and Stats counts them.
+func (c *Client) JoinState(roomId string) (JoinState, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.joined[roomId]; !ok {
+		return JoinPending, ErrNotJoined
+	}
+	if err, ok := c.refused[roomId]; ok {
+		return JoinRefused, err
+	}
+	if c.entered[roomId] {
+		return JoinConfirmed, nil
+	}
+	return JoinPending, nil
+}
+
+// A RoomJoin describes a room for JoinAll to join. Password is only needed for
+// password protected rooms. MaxHistory limits the messages of history the room
+// sends on joining: zero leaves it to the room and a negative number asks for
+// none. With Wait set, JoinAll waits for the room to confirm the join, as
+// JoinSync does.
+type RoomJoin struct {
+	RoomId     string
+	Nick       string
+	Password   string
+	MaxHistory int
+	Wait       bool
+}
+
+// JoinAll joins several rooms, one after the other, and returns the error
+// joining each room that failed, by room id. The joins are paced as set with
+// WithSendInterval. Joins with Wait set are confirmed concurrently once all the
+// joins have been sent, each within the request timeout (see
+// WithRequestTimeout).
+func (c *Client) JoinAll(rooms []RoomJoin) map[string]error {
+	errs := make(map[string]error)
+	if _, err := c.conn(); err != nil {
+		for _, r := range rooms {
+			errs[r.RoomId] = err
+		}
+		return errs
+	}
+
+	waits := make(map[string]chan error)
+	for i, r := range rooms {
+		if i > 0 && c.config.sendInterval > 0 && !c.wait(c.config.sendInterval) {
+			for _, r := range rooms[i:] {
+				errs[r.RoomId] = ErrNotConnected
+			}
+			break
+		}
+
+		maxStanzas := r.MaxHistory
+		switch {
+		case maxStanzas == 0:
+			maxStanzas = -1
+		case maxStanzas < 0:
+			maxStanzas = 0
+		}
+
+		// registered before joining so the room's answer cannot be missed,
+		// but sent without the lock, which the listener needs
+		ch := make(chan error, 1)
+		c.mu.Lock()
+		if r.Wait {
+			c.joining[r.RoomId] = ch
+		}
+		nick, joined := c.joined[r.RoomId]
+		password := c.passwords[r.RoomId]
+		c.joined[r.RoomId] = r.Nick
+		c.passwords[r.RoomId] = r.Password
+		c.mu.Unlock()
+		err := c.write(func(conn *xmpp.Conn) error {
+			return conn.MUCJoin(r.RoomId+"/"+r.Nick, c.JID(), r.Password, maxStanzas, time.Time{})
+		})
+		if err != nil {
+			c.mu.Lock()
+			if r.Wait && c.joining[r.RoomId] == ch {
+				delete(c.joining, r.RoomId)
+			}
+			if joined {
+				c.joined[r.RoomId], c.passwords[r.RoomId] = nick, password
+			} else {
+				delete(c.joined, r.RoomId)
+				delete(c.passwords, r.RoomId)
+			}
+			c.mu.Unlock()
+		}
+
+		if err != nil {
+			errs[r.RoomId] = err
+		} else if r.Wait {
+			waits[r.RoomId] = ch
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.config.requestTimeout)
+	defer cancel()
+	for roomId, ch := range waits {
+		select {
+		case err := <-ch:
+			if err != nil {
+				errs[roomId] = err
+			}
+		case <-ctx.Done():
+			errs[roomId] = ctx.Err()
+		}
+	}
+
+	c.mu.Lock()
+	for roomId, ch := range waits {
+		if c.joining[roomId] == ch {
+			delete(c.joining, roomId)
+		}
+		if errs[roomId] != nil && errs[roomId] != context.DeadlineExceeded {
+			delete(c.joined, roomId)
+		}
+	}
+	c.mu.Unlock()
+	return errs
+}
+
+// joinedRoom records the outcome of joining roomId, with the status codes the
+// room confirmed it with, and hands it to JoinSync if it is waiting for it.
+func (c *Client) joinedRoom(roomId string, codes []int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil {
+		c.joinCodes[roomId] = codes
+		c.entered[roomId] = true
+		delete(c.refused, roomId)
+	} else {
+		c.refused[roomId] = err
+	}
+	if ch, ok := c.joining[roomId]; ok {
+		delete(c.joining, roomId)
+		ch <- err
+	}
+}
+
+// UserStatus returns the availability and status text last received from a
+// user. show is "available" unless the user is away ("away", "xa") or busy
+// ("dnd"). ok is false if the user is offline or no presence has been received
+// from them.
+func (c *Client) UserStatus(jid string) (show string, statusText string, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.statuses[bareJID(jid)]
+	return s.show, s.text, ok
+}
+
+// UserCustomStatus works like UserStatus, but splits an emoticon at the start
+// of the status text, as sent by SetCustomStatus, out into emoji.
+func (c *Client) UserCustomStatus(jid string) (show, statusText, emoji string, ok bool) {
+	show, statusText, ok = c.UserStatus(jid)
+	if e := ParseEmoticons(statusText); len(e) != 0 && e[0].Start == 0 {
+		emoji = e[0].Shortcut
+		statusText = strings.TrimSpace(statusText[e[0].End:])
+	}
+	return show, statusText, emoji, ok
+}
+
+func (c *Client) setStatus(jid, typ, show, text string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch typ {
+	case "":
+		if show == "" || show == "chat" {
+			show = "available"
+		}
+		c.statuses[jid] = status{show: show, text: text}
+	case "unavailable":
+		delete(c.statuses, jid)
+	}
+}
+
+// Topic returns the topic of a room. HipChat sends the topic when the room is
+// joined and whenever it changes; the last one received is returned.
+func (c *Client) Topic(roomId string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if topic, ok := c.topics[roomId]; ok {
+		return topic, nil
+	}
+	if _, ok := c.joined[roomId]; !ok {
+		return "", ErrNotJoined
+	}
+	return "", ErrNoTopic
+}
+
+// SetTopic changes the topic of a room.
+func (c *Client) SetTopic(roomId, topic string) error {
+	return c.write(func(conn *xmpp.Conn) error {
+		return conn.MUCSubject(roomId, c.JID(), topic)
+	})
+}
+
+// ClearTopic removes the topic of a room.
+func (c *Client) ClearTopic(roomId string) error {
+	return c.SetTopic(roomId, "")
+}
+
+// TopicSetBy returns the nickname of the occupant who set the current topic of
+// a room and when they set it, as sent by HipChat along with the topic. nick is
+// empty if the topic was sent by the room itself rather than an occupant. ok
+// is false if no topic has been received for the room.
+func (c *Client) TopicSetBy(roomId string) (nick string, at time.Time, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	setter, ok := c.topicSetters[roomId]
+	return setter.nick, setter.at, ok
+}
+
+// saveDelay is how long saveLastSeen waits after a message is seen before
+// saving, so a busy room is not saved for every message.
+const saveDelay = time.Second
+
+// seen records t as the time of the last message received in a room, for
+// saveLastSeen to save in the Store set with WithStore. The listener calls it
+// for every room message, so it does not wait for the Store.
+func (c *Client) seen(roomId string, t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !t.After(c.lastSeen[roomId]) {
+		return
+	}
+	c.lastSeen[roomId] = t
+	if c.config.store == nil {
+		return
+	}
+	c.unsaved[roomId] = t
+	select {
+	case c.seenUnsaved <- struct{}{}:
+	default:
+	}
+}
+
+// saveLastSeen saves the times recorded by seen in the Store, at most once
+// every saveDelay, until the client is disconnected, when it saves what is
+// left.
+func (c *Client) saveLastSeen() {
+	defer c.saver.Done()
+	for {
+		select {
+		case <-c.seenUnsaved:
+			if !c.wait(saveDelay) {
+				c.saveUnsaved()
+				return
+			}
+			c.saveUnsaved()
+		case <-c.done:
+			c.saveUnsaved()
+			return
+		}
+	}
+}
+
+// saveUnsaved saves the times seen since it last ran.
+func (c *Client) saveUnsaved() {
+	c.mu.Lock()
+	unsaved := c.unsaved
+	c.unsaved = make(map[string]time.Time)
+	c.mu.Unlock()
+
+	for roomId, t := range unsaved {
+		if err := c.config.store.Save(roomId, t); err != nil {
+			c.log("Unable to save last seen message time:", roomId, err)
+		}
+	}
+}
+
+// rejoin joins the rooms the client was in before reconnecting. Unless
+// WithReplayMissed is set, no history is requested so messages are not
+// delivered twice.
+func (c *Client) rejoin(disconnected time.Time) {
+	conn, err := c.conn()
+	if err != nil {
+		return
+	}
+
+	for roomId, resource := range c.joinedRooms() {
+		var since time.Time
+		c.mu.Lock()
+		// the room sends everyone's presence again once rejoined
+		delete(c.occupants, roomId)
+		delete(c.entered, roomId)
+		c.cancelLeaves(roomId)
+		if c.config.replayMissed > 0 {
+			since = c.lastSeen[roomId]
+			if since.IsZero() {
+				since = disconnected
+			}
+		}
+		password := c.passwords[roomId]
+		c.mu.Unlock()
+		conn.MUCJoin(roomId+"/"+resource, c.JID(), password, c.config.replayMissed, since)
+	}
+}
+
+func (c *Client) setTopic(roomId, topic string, setter topicSetter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.topicSetters[roomId] = setter
+	if old, ok := c.topics[roomId]; ok && old == topic {
+		return
+	}
+	c.topics[roomId] = topic
+	c.notifyRoomState(roomId)
+}
+
+// setOccupant records the presence of a room occupant, who has left the room
+// unless present is set.
+func (c *Client) setOccupant(p *RoomPresence, present bool) {
+	if p.Nick == "" {
+		return
+	}
+	roomId, nick := p.Room, p.Nick
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	occupants := c.occupants[roomId]
+	_, ok := occupants[nick]
+	if !present {
+		if ok {
+			delete(occupants, nick)
+			c.notifyRoomState(roomId)
+		}
+		return
+	}
+	if occupants == nil {
+		occupants = make(map[string]*RoomPresence)
+		c.occupants[roomId] = occupants
+	}
+	if old, ok := occupants[nick]; ok {
+		// a later presence of someone already there
+		p.Joined = old.Joined
+	}
+	occupants[nick] = p
+	if !ok {
+		c.notifyRoomState(roomId)
+	}
+}
+
+// occupantChanged reports an occupant other than the client joining or
+// leaving a room, debouncing leaves, see OccupantEvents. It must be called
+// before the presence is recorded with setOccupant.
+func (c *Client) occupantChanged(p *RoomPresence, present bool) {
+	if p.Nick == "" {
+		return
+	}
+	occupant := p.Room + "/" + p.Nick
+	event := &OccupantEvent{Room: p.Room, Nick: p.Nick, JID: p.JID, Type: "join", Time: p.Time}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, known := c.occupants[p.Room][p.Nick]; !c.entered[p.Room] || present == known {
+		// the room listing who is already there, or a presence update
+		return
+	}
+	if present {
+		if timer, ok := c.leaving[occupant]; ok {
+			// back before the leave was reported
+			timer.Stop()
+			delete(c.leaving, occupant)
+			return
+		}
+		c.notifyOccupant(event)
+		return
+	}
+
+	event.Type = "leave"
+	if c.config.debounce <= 0 {
+		c.notifyOccupant(event)
+		return
+	}
+	if timer, ok := c.leaving[occupant]; ok {
+		timer.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(c.config.debounce, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.leaving[occupant] != timer {
+			return
+		}
+		delete(c.leaving, occupant)
+		// channels are closed once the client is disconnected
+		if !c.closed() {
+			c.notifyOccupant(event)
+		}
+	})
+	c.leaving[occupant] = timer
+}
+
+// cancelLeaves drops the leave events waiting to be reported for a room, whose
+// occupants are listed again on rejoining. c.mu must be held.
+func (c *Client) cancelLeaves(roomId string) {
+	for occupant, timer := range c.leaving {
+		if bareJID(occupant) == roomId {
+			timer.Stop()
+			delete(c.leaving, occupant)
+		}
+	}
+}
+
+// notifyOccupant sends an occupant event without blocking. c.mu must be held.
+func (c *Client) notifyOccupant(e *OccupantEvent) {
+	select {
+	case c.occupantEvents <- e:
+	default:
+	}
+}
+
+// Occupants returns the occupants of a joined room, as last reported by the
+// room, or ErrNotJoined. JID is empty for rooms that do not reveal who their
+// occupants are.
+func (c *Client) Occupants(roomId string) ([]*Occupant, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.joined[roomId]; !ok {
+		return nil, ErrNotJoined
+	}
+
+	occupants := []*Occupant{}
+	for nick, p := range c.occupants[roomId] {
+		occupants = append(occupants, &Occupant{Nick: nick, JID: p.JID, Joined: p.Joined})
+	}
+	sort.Slice(occupants, func(i, j int) bool { return occupants[i].Nick < occupants[j].Nick })
+	return occupants, nil
+}
+
+// OccupantPresence returns the last presence received from the occupant of a
+// room with the given nick, and false if there is no such occupant, or they
+// have left.
+func (c *Client) OccupantPresence(roomId, nick string) (*RoomPresence, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.occupants[roomId][nick]
+	if !ok {
+		return nil, false
+	}
+	presence := *p
+	presence.StatusCodes = append([]int(nil), p.StatusCodes...)
+	return &presence, true
+}
+
+// notifyRoomState sends the state of roomId on RoomStates. c.mu must be held.
+func (c *Client) notifyRoomState(roomId string) {
+	select {
+	case c.roomStates <- &RoomState{
+		Room:      roomId,
+		Occupants: len(c.occupants[roomId]),
+		Topic:     c.topics[roomId],
+	}:
+	default:
+	}
+}
+
+// Say accepts a room id, the name of the client in the room, and the message
+// body and sends the message to the HipChat room. It returns ErrNotConnected
+// while the client is not connected, or the error writing the message.
+//
+// Saying something does not put the room in the recent lists of HipChat's own
+// clients. Those lists are kept by each person's client from the rooms they
+// open themselves; no presence or message element HipChat accepts over XMPP,
+// standard or proprietary, adds a room to them, so there is no option for it.
+func (c *Client) Say(to, name, body string) error {
+	_, err := c.SayWithID(to, name, body)
+	return err
+}
+
+// Ask says prompt to a room or user like Say and waits for the answer: the
+// next message said in the room by someone other than the client, or the next
+// chat from the user. It returns context.DeadlineExceeded if no answer arrives
+// within timeout and ErrNotConnected if the client is disconnected first.
+// Answers are picked from the messages delivered on Messages, which still
+// receives them too.
+func (c *Client) Ask(to, name, prompt string, timeout time.Duration) (*Message, error) {
+	room := c.isRoom(to)
+	return c.AskFunc(to, name, prompt, timeout, func(m *Message) bool {
+		if room {
+			return m.Type == "groupchat" && bareJID(m.From) == to && !m.IsOwn
+		}
+		return m.Type == "chat" && bareJID(m.From) == bareJID(to) && !m.Carbon
+	})
+}
+
+// AskFunc works like Ask, but the answer is the first message received after
+// prompt for which match returns true.
+func (c *Client) AskFunc(to, name, prompt string, timeout time.Duration, match func(*Message) bool) (*Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// subscribe first so a quick answer is not missed
+	messages := c.MessagesContext(ctx)
+	if err := c.Say(to, name, prompt); err != nil {
+		return nil, err
+	}
+	for {
+		select {
+		case m, ok := <-messages:
+			if !ok {
+				return nil, ctx.Err()
+			}
+			if match(m) {
+				return m, nil
+			}
+		case <-c.done:
+			return nil, ErrNotConnected
+		}
+	}
+}
+
+// SayToUser sends body to a user in a chat addressed to their bare JID, with
+// any resource in userJid removed, so that HipChat delivers it to every client
+// the user is logged in with, such as their desktop and their phone. A chat
+// sent with Say to a JID with a resource only reaches that one client, or
+// none if it has logged out. name is the client's resource the chat is sent
+// from. It returns ErrNotConnected while the client is not connected, or the
+// error writing the message.
+func (c *Client) SayToUser(userJid, name, body string) error {
+	return c.Say(bareJID(userJid), name, body)
+}
+
+// SayToRoom says body to room like Say, using its Id.
+func (c *Client) SayToRoom(room *Room, name, body string) error {
+	if room == nil || room.Id == "" {
+		return ErrInvalidRoom
+	}
+	return c.Say(room.Id, name, body)
+}
+
+// SayLong works like Say, but splits a body longer than HipChat allows into
+// several messages, sent in order. The body is split at a newline where
+// possible and anywhere else otherwise; the newlines split at are not sent,
+// nor are empty messages. The messages are paced as set with WithSendInterval.
+// See WithMaxMessageLength.
+func (c *Client) SayLong(to, name, body string) error {
+	// filter before splitting, so the chunks still fit once filtered
+	for i, chunk := range splitMessage(c.filter(body), c.config.maxLength) {
+		if i > 0 && c.config.sendInterval > 0 && !c.wait(c.config.sendInterval) {
+			return ErrNotConnected
+		}
+		if _, err := c.sayWithID(to, name, chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitMessage splits body into chunks of at most max bytes, breaking at the
+// last newline that fits, which is dropped, or else after the last whole rune
+// that fits. No chunk is empty.
+func splitMessage(body string, max int) []string {
+	var chunks []string
+	for max > 0 && len(body) > max {
+		// a newline right after a full chunk is as good as one inside it
+		if i := strings.LastIndex(body[:max+1], "\n"); i > 0 {
+			chunks = append(chunks, body[:i])
+			body = body[i+1:]
+			continue
+		} else if i == 0 {
+			body = body[1:]
+			continue
+		}
+
+		i := max
+		for i > 0 && !utf8.RuneStart(body[i]) {
+			i--
+		}
+		if i == 0 {
+			// max is shorter than the first rune, which is kept whole
+			_, i = utf8.DecodeRuneInString(body)
+		}
+		chunks = append(chunks, body[:i])
+		body = body[i:]
+	}
+	if body != "" {
+		chunks = append(chunks, body)
+	}
+	return chunks
+}
+
+// SayWithID works like Say and returns the id of the sent message, which can
+// be passed to Replace to correct it.
+func (c *Client) SayWithID(to, name, body string) (string, error) {
+	return c.sayWithID(to, name, c.filter(body))
+}
+
+// sayWithID works like SayWithID, without passing body through the outgoing
+// filter.
+func (c *Client) sayWithID(to, name, body string) (string, error) {
+	if !c.isRoom(to) {
+		return c.send(func(conn *xmpp.Conn) (string, error) {
+			return conn.Send(to, c.JID()+"/"+name, body)
+		})
+	}
+	if c.config.echoTimeout <= 0 {
+		return c.send(func(conn *xmpp.Conn) (string, error) {
+			return conn.MUCSend(to, c.JID()+"/"+name, body)
+		})
+	}
+
+	// register before sending so the echo cannot be missed, but write without
+	// the lock, which the listener needs to keep reading
+	ch := make(chan error, 1)
+	id, err := c.send(func(conn *xmpp.Conn) (string, error) {
+		id := conn.NewID()
+		c.mu.Lock()
+		c.echoes[id] = ch
+		c.mu.Unlock()
+		return id, conn.MUCSendID(id, to, c.JID()+"/"+name, body)
+	})
+	if err != nil {
+		c.mu.Lock()
+		delete(c.echoes, id)
+		c.mu.Unlock()
+		return id, err
+	}
+
+	timer := time.NewTimer(c.config.echoTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-ch:
+		return id, err
+	case <-timer.C:
+		c.mu.Lock()
+		delete(c.echoes, id)
+		c.mu.Unlock()
+		return id, ErrNoEcho
+	}
+}
+
+// echoed hands the echo of the message with the given id to the Say waiting
+// for it.
+func (c *Client) echoed(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ch, ok := c.echoes[id]; ok {
+		delete(c.echoes, id)
+		ch <- nil
+	}
+}
+
+// Reply answers msg where it was received: in the same room, @mentioning the
+// sender, or in a direct message to the sender. The sender can only be
+// mentioned if the room reveals who they are and they are on the client's
+// roster; otherwise the reply is sent without the mention.
+func (c *Client) Reply(msg *Message, body string) error {
+	if msg.Type != "groupchat" {
+		return c.Say(bareJID(msg.From), c.Resource, body)
+	}
+
+	roomId := bareJID(msg.From)
+	nick := strings.TrimPrefix(msg.From[len(roomId):], "/")
+	c.mu.Lock()
+	name, ok := c.joined[roomId]
+	if !ok {
+		name = c.Resource
+	}
+	var mention string
+	if p, ok := c.occupants[roomId][nick]; ok && p.JID != "" {
+		mention = c.mentionNames[bareJID(p.JID)]
+	}
+	c.mu.Unlock()
+
+	if mention != "" {
+		body = "@" + mention + " " + body
+	}
+	return c.Say(roomId, name, body)
+}
+
+// SayReply works like Say, but marks the message as a reply to the message
+// with id inReplyToID (XEP-0461), so clients that support replies can show it
+// in context. Clients that do not show it as an ordinary message.
+func (c *Client) SayReply(to, name, body, inReplyToID string) error {
+	body = c.filter(body)
+	_, err := c.send(func(conn *xmpp.Conn) (string, error) {
+		if c.isRoom(to) {
+			return conn.MUCReply(to, c.JID()+"/"+name, inReplyToID, body)
+		}
+		return conn.Reply(to, c.JID()+"/"+name, inReplyToID, body)
+	})
+	return err
+}
+
+// SetOutgoingFilter sets a function every message body the client sends is
+// passed through first, with Say, SayLong, SayReply, Replace and everything
+// built on them, such as Reply and scheduled messages. It is the place for
+// policy that applies to all messages, such as tagging them or redacting
+// secrets. SayLong filters the whole body before splitting it, so the filter
+// is free to make it longer. A nil fn, the default, sends bodies unchanged.
+func (c *Client) SetOutgoingFilter(fn func(body string) string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.outgoingFilter = fn
+}
+
+// filter passes body through the outgoing filter, if one is set.
+func (c *Client) filter(body string) string {
+	c.mu.Lock()
+	fn := c.outgoingFilter
+	c.mu.Unlock()
+	if fn == nil {
+		return body
+	}
+	return fn(body)
+}
+
+// send writes a message with write, or returns ErrNotConnected while the
+// client is not connected. Close waits for it to finish writing.
+func (c *Client) send(write func(*xmpp.Conn) (string, error)) (string, error) {
+	c.sending.RLock()
+	defer c.sending.RUnlock()
+	conn, err := c.conn()
+	if err != nil {
+		return "", err
+	}
+	return write(conn)
+}
+
+// write works like send for writes that do not return a message id.
+func (c *Client) write(write func(*xmpp.Conn) error) error {
+	_, err := c.send(func(conn *xmpp.Conn) (string, error) {
+		return "", write(conn)
+	})
+	return err
+}
+
+// Replace corrects a previously sent message (XEP-0308). originalID is the id
+// returned by SayWithID for the first version of the message, even when it has
+// already been corrected. Clients that do not support corrections show the new
+// body as a separate message.
+func (c *Client) Replace(to, name, originalID, newBody string) error {
+	newBody = c.filter(newBody)
+	_, err := c.send(func(conn *xmpp.Conn) (string, error) {
+		if c.isRoom(to) {
+			return conn.MUCReplace(to, c.JID()+"/"+name, originalID, newBody)
+		}
+		return conn.Replace(to, c.JID()+"/"+name, originalID, newBody)
+	})
+	return err
+}
+
+// SendRaw writes a single raw XML stanza to the stream. It is intended for
+// experimenting with extensions the library does not support. The stanza must
+// be one well-formed element outside of the stream namespace so that it cannot
+// open, close or otherwise corrupt the stream itself.
+func (c *Client) SendRaw(stanza string) error {
+	if err := validateStanza(stanza); err != nil {
+		return err
+	}
+	return c.write(func(conn *xmpp.Conn) error {
+		return conn.Raw(stanza)
+	})
+}
+
+// KeepAlive is meant to run as a goroutine. It sends a single whitespace
+// character to HipChat every 60 seconds. This keeps the connection from
+// idling after 150 seconds. It returns when the client is disconnected.
+func (c *Client) KeepAlive() {
+	ticker := time.NewTicker(60 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if conn, err := c.conn(); err == nil {
+				conn.KeepAlive()
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// closeTimeout bounds how long Close spends saying goodbye to HipChat. It is a
+// variable so tests need not wait as long.
+var closeTimeout = 5 * time.Second
+
+// Close shuts the client down gracefully: it waits for messages being said to
+// be written, leaves the joined rooms, tells HipChat it is going offline and
+// ends the stream before closing the connection. Otherwise it works like
+// Disconnect. It gives up on a connection that does not accept these writes
+// within 5 seconds, and returns the first error writing or closing. Close
+// makes the Client an io.Closer.
+func (c *Client) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.mu.Lock()
+		connected := c.connected
+		c.connected = false
+		conn := c.connection
+		c.stopSchedules()
+		c.mu.Unlock()
+
+		keep := func(e error) {
+			if err == nil {
+				err = e
+			}
+		}
+		// the deadline also applies to messages still being written, so a
+		// stalled connection cannot keep Close waiting for them
+		if connected {
+			keep(conn.SetDeadline(time.Now().Add(closeTimeout)))
+		}
+
+		// no message starts being written once disconnected
+		c.sending.Lock()
+		defer c.sending.Unlock()
+
+		if connected {
+			for roomId, resource := range c.joinedRooms() {
+				keep(conn.MUCPart(roomId+"/"+resource, c.JID()))
+			}
+			keep(conn.Unavailable(c.JID()))
+		}
+		keep(conn.Close())
+		c.saver.Wait()
+	})
+	return err
+}
+
+// Disconnect closes the connection to HipChat. The client does not reconnect
+// afterwards and its background goroutines stop.
+func (c *Client) Disconnect() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.mu.Lock()
+		c.connected = false
+		conn := c.connection
+		c.stopSchedules()
+		c.mu.Unlock()
+		err = conn.Close()
+		c.saver.Wait()
+	})
+	return err
+}
+
+// stop disconnects the client for good, as Disconnect does, recording err as
+// the reason for Err.
+func (c *Client) stop(err error) {
+	c.mu.Lock()
+	c.stopErr = err
+	c.mu.Unlock()
+	c.Disconnect()
+}
+
+// Err returns why the client stopped by itself, such as ErrConflict, once its
+// channels have been closed without Disconnect being called. It returns nil
+// while the client is running and after Disconnect.
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stopErr
+}
+
+// forceDisconnect closes the connection as if it had failed with err, so that
+// the client goes through its reconnect path. It lets tests exercise
+// reconnecting deterministically; hipchattest.Server.Drop does the same from
+// the server's side.
+func (c *Client) forceDisconnect(err error) {
+	c.mu.Lock()
+	c.forced = err
+	conn := c.connection
+	c.mu.Unlock()
+	conn.Close()
+}
+
+// refreshPresence re-sends presence to the joined rooms every interval until
+// the client is disconnected. Each room is sent the presence set for it with
+// SetRoomPresence, or else the client's own, such as do not disturb; it is not
+// joined again, so it does not replay history or announce the client.
+func (c *Client) refreshPresence(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			conn, err := c.conn()
+			if err != nil {
+				continue
+			}
+			for roomId, resource := range c.joinedRooms() {
+				p := c.presenceIn(roomId)
+				if err := conn.MUCStatus(roomId+"/"+resource, c.JID(), p.show, p.text); err != nil {
+					c.log("Unable to refresh presence in room:", roomId, err)
+				}
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// presenceIn returns the client's presence in roomId.
+func (c *Client) presenceIn(roomId string) status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p, ok := c.roomPresence[roomId]; ok {
+		return p
+	}
+	if c.presence != nil {
+		return *c.presence
+	}
+	return status{show: "chat"}
+}
+
+// request sends an iq with the given id with send and waits until HipChat
+// replies to it or ctx is done. An error reply is returned as a *StanzaError.
+func (c *Client) request(ctx context.Context, send func(conn *xmpp.Conn, id string) error) (*xmpp.IQ, error) {
+	return c.requestID(ctx, "", send)
+}
+
+// requestID works like request, but sends the iq with id, or a new one if id
+// is empty.
+func (c *Client) requestID(ctx context.Context, id string, send func(conn *xmpp.Conn, id string) error) (*xmpp.IQ, error) {
+	conn, err := c.conn()
+	if err != nil {
+		return nil, err
+	}
+	if id == "" {
+		id = conn.NewID()
+	}
+
+	// register before sending so the reply cannot be missed, but write
+	// without the lock, which the listener needs to keep reading
+	ch := make(chan *xmpp.IQ, 1)
+	c.mu.Lock()
+	c.pending[id] = ch
+	c.mu.Unlock()
+	err = c.write(func(conn *xmpp.Conn) error { return send(conn, id) })
+	if err != nil {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		return nil, err
+	}
+
+	select {
+	case iq := <-ch:
+		if iq == nil {
+			return nil, ErrNotConnected
+		}
+		if iq.Type == "error" {
+			return nil, stanzaError(iq.Error)
+		}
+		return iq, nil
+	case <-ctx.Done():
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// reply hands iq to the request waiting for it and reports whether there was
+// one.
+func (c *Client) reply(iq *xmpp.IQ) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch, ok := c.pending[iq.ID]
+	if ok {
+		delete(c.pending, iq.ID)
+		ch <- iq
+	}
+	return ok
+}
+
+// failPending wakes every waiting request with ErrNotConnected after the
+// connection is lost, as their replies will never arrive.
+func (c *Client) failPending() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, ch := range c.pending {
+		delete(c.pending, id)
+		ch <- nil
+	}
+	for roomId, ch := range c.joining {
+		delete(c.joining, roomId)
+		ch <- ErrNotConnected
+	}
+	for id, ch := range c.echoes {
+		delete(c.echoes, id)
+		ch <- ErrNotConnected
+	}
+}
+
+func stanzaError(e *xmpp.StanzaError) *StanzaError {
+	if e == nil {
+		return &StanzaError{Condition: "undefined-condition"}
+	}
+	return &StanzaError{Type: e.Type, Condition: e.Condition(), Text: e.Text}
+}
+
+// conn returns the connection to HipChat, or ErrNotConnected while the client
+// is disconnected or reconnecting.
+func (c *Client) conn() (*xmpp.Conn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.connected {
+		return nil, ErrNotConnected
+	}
+	return c.connection, nil
+}
+
+// joinedRooms returns a copy of the joined rooms and the resource used in each.
+func (c *Client) joinedRooms() map[string]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rooms := make(map[string]string, len(c.joined))
+	for roomId, resource := range c.joined {
+		rooms[roomId] = resource
+	}
+	return rooms
+}
+
+// log logs v, as fmt.Println formats it, with the logger set with WithLogger.
+func (c *Client) log(v ...interface{}) {
+	c.config.logger.Println(v...)
+}
+
+// closed reports whether Disconnect has been called.
+func (c *Client) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func validateStanza(stanza string) error {
+	d := xml.NewDecoder(strings.NewReader(stanza))
+	depth, elements := 0, 0
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("invalid stanza: %v", err)
+		}
+
+		switch t := t.(type) {
+		case xml.StartElement:
+			if depth == 0 {
+				// an undeclared stream: prefix is left as the space
+				if t.Name.Space == xmpp.NsStream || t.Name.Space == "stream" {
+					return errors.New("invalid stanza: stream elements are not allowed")
+				}
+				elements++
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+		case xml.CharData:
+			if depth == 0 && len(strings.TrimSpace(string(t))) != 0 {
+				return errors.New("invalid stanza: text outside of element")
+			}
+		case xml.ProcInst, xml.Directive:
+			return errors.New("invalid stanza: declarations are not allowed")
+		}
+	}
+
+	if elements != 1 {
+		return errors.New("invalid stanza: expected exactly one element")
+	}
+	return nil
+}
+
+func (c *Client) updateMentionNames(users []*User) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, u := range users {
+		c.mentionNames[u.Id] = u.MentionName
+		c.names[u.Id] = u.Name
+	}
+}
+
+func (c *Client) removeMentionName(u *User) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.mentionNames, u.Id)
+	delete(c.names, u.Id)
+}
+
+func (c *Client) authenticate() error {
+	var sasl bool   // authenticated with SASL and waiting to bind
+	var secure bool // the stream is using TLS
+	c.mu.Lock()
+	c.handshake = nil
+	c.mu.Unlock()
+
+	c.restartStream()
+	for {
+		element, err := c.connection.Next()
+		if err != nil {
+			return err
+		}
+
+		switch element.Name.Local + element.Name.Space {
+		case "stream" + xmpp.NsStream:
+			// every stream, including the ones restarted after StartTLS and
+			// SASL, begins with its features, and what to negotiate next
+			// depends only on them and what has been negotiated so far
+			features, err := c.connection.Features()
+			if err != nil {
+				return err
+			}
+			detail := "mechanisms " + strings.Join(features.Mechanisms, " ")
+			if features.StartTLS != nil {
+				detail = "starttls, " + detail
+			}
+			c.step("features", detail)
+			if features.Caps != nil {
+				c.mu.Lock()
+				c.serverCaps = features.Caps
+				c.mu.Unlock()
+			}
+
+			if sasl {
+				c.step("bind", c.Resource)
+				c.connection.Bind(c.Resource)
+			} else if !secure && !c.config.disableTLS {
+				// never fall back to cleartext, the offer may have been
+				// stripped from the features
+				if features.StartTLS == nil {
+					return errors.New("server did not offer StartTLS")
+				}
+				c.step("starttls", "")
+				c.connection.StartTLS()
+			} else {
+				if c.config.disableTLS {
+					c.log("WARNING: TLS is disabled, authenticating over a cleartext connection")
+				}
+				if err := c.startAuth(features.Mechanisms); err != nil {
+					return err
+				}
+			}
+		case "proceed" + xmpp.NsTLS:
+			err := c.connection.UseTLS(&tls.Config{
+				ServerName:   c.config.tlsServerName,
+				Certificates: c.config.certificates,
+				RootCAs:      c.config.rootCAs,
+				MinVersion:   c.config.minTLSVersion,
+			})
+			if err != nil {
+				c.step("tls", err.Error())
+				return fmt.Errorf("TLS handshake failed: %v", err)
+			}
+			secure = true
+			state, _ := c.connection.TLSState()
+			c.step("tls", tlsVersionName(state.Version)+" "+fmt.Sprintf("%#04x", state.CipherSuite))
+			c.restartStream()
+		case "success" + xmpp.NsSASL:
+			sasl = true
+			c.step("success", "")
+			c.restartStream()
+		case "failure" + xmpp.NsSASL:
+			condition, text := c.connection.SASLFailure(&element)
+			c.step("failure", condition)
+			if c.config.authzid != "" && (condition == "invalid-authzid" || condition == "not-authorized") {
+				if text != "" {
+					return fmt.Errorf("%w: %s", ErrAuthzidRefused, text)
+				}
+				return fmt.Errorf("%w: %s", ErrAuthzidRefused, condition)
+			}
+			return errors.New("could not authenticate")
+		case "iq" + xmpp.NsJabberClient:
+			iq := c.connection.IQ(&element)
+			if iq.Type != "result" {
+				c.step("failure", iq.Type)
+				if iq.Error != nil && iq.Error.Condition() == "conflict" {
+					return ErrConflict
+				}
+				return errors.New("could not authenticate")
+			}
+
+			// legacy auth binds the requested resource and does not say so
+			jid := c.JID() + "/" + c.Resource
+			if iq.Bind != nil && iq.Bind.Jid != "" {
+				jid = iq.Bind.Jid
+			}
+			c.step("bound", jid)
+			if c.config.authzid != "" && bareJID(jid) != bareJID(c.config.authzid) {
+				return fmt.Errorf("%w: server bound %s", ErrAuthzidRefused, jid)
+			}
+			c.mu.Lock()
+			c.fullJID = jid
+			if c.config.anonymous || c.config.authzid != "" {
+				// a new JID is assigned on every anonymous login, and the
+				// session acts as the authorization identity
+				c.jid = bareJID(jid)
+			}
+			c.mu.Unlock()
+			return nil // authenticated
+		}
+	}
+}
+
+// tlsVersionName returns the name of TLS version v. tls.VersionName would do,
+// but needs a newer Go than the client otherwise requires.
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("%#04x", v)
+}
+
+// restartStream opens a new stream, as the client does when it connects and
+// again after each negotiation step that changes the connection, such as TLS
+// and SASL. The server answers by opening its own stream, and authenticate
+// reads the new features then, so it copes with any number of restarts.
+func (c *Client) restartStream() {
+	c.step("stream", "")
+	c.connection.Stream(c.JID(), c.config.xmppDomain)
+}
+
+// startAuth starts authenticating with the best of the offered SASL
+// mechanisms the client can use.
+func (c *Client) startAuth(offered []string) error {
+	switch {
+	case c.config.anonymous:
+		if hasMechanism(offered, "ANONYMOUS") {
+			c.step("auth", "ANONYMOUS")
+			return c.connection.SASLAuth("ANONYMOUS", "=")
+		}
+	case c.config.authzid != "":
+		// legacy auth has no authorization identity, only SASL PLAIN does
+		if hasMechanism(offered, "PLAIN") {
+			c.step("auth", "PLAIN as "+c.config.authzid)
+			response := c.config.authzid + "\x00" + c.Username + "\x00" + c.Password
+			return c.connection.SASLAuth("PLAIN", base64.StdEncoding.EncodeToString([]byte(response)))
+		}
+	case len(c.config.certificates) != 0 && hasMechanism(offered, "EXTERNAL"):
+		c.step("auth", "EXTERNAL")
+		return c.connection.SASLAuth("EXTERNAL", "=")
+	case hasMechanism(offered, "PLAIN"):
+		// the password is sent with legacy auth, as it always has been
+		c.step("auth", "jabber:iq:auth")
+		c.connection.Auth(c.Username, c.Password, c.Resource)
+		return nil
+	}
+	if len(offered) == 0 {
+		offered = []string{"none"}
+	}
+	return fmt.Errorf("%w, server offered %s", ErrNoSupportedAuthMechanism, strings.Join(offered, ", "))
+}
+
+func hasMechanism(mechanisms []string, mechanism string) bool {
+	for _, m := range mechanisms {
+		if m == mechanism {
+			return true
+		}
+	}
+	return false
+}
+
+// reconnect is called when the connection is lost and retries connecting with
+// an increasing delay. If HipChat closed the stream because the client was
+// flooding it, the delay is much longer so reconnecting does not make it worse.
+// It panics if HipChat cannot be reached.
+func (c *Client) reconnect(err error, condition string) {
+	delay := time.Second
+	if rateLimited(condition) {
+		delay = 30 * time.Second
+		c.log("Disconnected for rate limiting:", condition)
+	}
+
+	info := ReconnectInfo{Err: err}
+	start := time.Now()
+	for m := 0; m < 5; m++ {
+		for i := 1; i < 11; i++ {
+			if !c.wait(time.Duration(i) * delay) {
+				c.closeChannels()
+				return
+			}
+			info.Attempts++
+			err = c.connect()
+			if c.closed() {
+				// Disconnect raced the new connection, which may have been
+				// made after it closed the old one
+				c.mu.Lock()
+				c.connected = false
+				conn := c.connection
+				c.mu.Unlock()
+				conn.Close()
+				c.closeChannels()
+				return
+			}
+			if err == ErrConflict && !c.config.retryConflict {
+				c.log("Resource in use by another session, not reconnecting")
+				c.stop(err)
+				c.closeChannels()
+				return
+			}
+			if err == nil {
+				// listen before rejoining, so the rooms' answers are read
+				// while the joins are written
+				go c.listen()
+				c.rejoin(start)
+				c.mu.Lock()
+				c.reconnects++
+				info.Count = c.reconnects
+				c.mu.Unlock()
+				info.Outage = time.Since(start)
+				select {
+				case c.onReconnect <- info:
+				default:
+				}
+				go c.sayOverdue()
+				return
+			}
+			c.log("Unable to connect err:", err)
+		}
+		if !c.wait(time.Duration(m) * time.Minute) {
+			c.closeChannels()
+			return
+		}
+	}
+	panic(err)
+}
+
+// wait sleeps for d and reports whether the client is still running, waking
+// up early if it is disconnected.
+func (c *Client) wait(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+// closeChannels closes the event channels after Disconnect. Only the listener,
+// and reconnect on its behalf, sends on them, so it is the one to close them.
+func (c *Client) closeChannels() {
+	// once done is closed Resume starts no flush after taking the lock, so
+	// after this any flush is counted in flusher
+	c.mu.Lock()
+	c.mu.Unlock()
+	c.flusher.Wait()
+	close(c.receivedMessage)
+	close(c.rosterUpdates)
+	close(c.mentions)
+	close(c.systemMessages)
+	close(c.messageErrors)
+	close(c.markers)
+	close(c.roomStates)
+	close(c.occupantEvents)
+	close(c.subscriptions)
+	close(c.onConnect)
+	close(c.onReconnect)
+}
+
+// rateLimited reports whether a stream error condition indicates HipChat
+// disconnected the client for sending too much.
+func rateLimited(condition string) bool {
+	return condition == "policy-violation" || condition == "resource-constraint"
+}
+
+// deliver hands m to the Messages channel, any MessagesContext channels and
+// the Mentions channel if it mentions the client, without blocking the
+// listener.
+func (c *Client) deliver(m *Message) {
+	c.mu.Lock()
+	if c.muted[m.Room] || c.muted[m.SenderJID] {
+		c.mu.Unlock()
+		return
+	}
+	if m.Type == "groupchat" && c.config.roomHistory > 0 {
+		roomId := bareJID(m.From)
+		history := append(c.history[roomId], m)
+		if len(history) > c.config.roomHistory {
+			history = history[len(history)-c.config.roomHistory:]
+		}
+		c.history[roomId] = history
+	}
+	if c.paused || c.flushing {
+		if len(c.held) < c.config.pauseBuffer {
+			c.held = append(c.held, m)
+		} else {
+			drops := atomic.AddInt64(&c.heldDrops, 1)
+			c.log("WARNING: pause buffer is full, dropped", describeMessage(m)+"; total dropped:", drops)
+		}
+	} else {
+		select {
+		case c.receivedMessage <- m:
+		default:
+			drops := atomic.AddInt64(&c.messageDrops, 1)
+			c.log("WARNING: Messages channel is full, dropped", describeMessage(m)+"; total dropped:", drops)
+		}
+	}
+	for ch := range c.subscribers {
+		select {
+		case ch <- m:
+		default:
+			drops := atomic.AddInt64(&c.contextDrops, 1)
+			c.log("WARNING: MessagesContext channel is full, dropped", describeMessage(m)+"; total dropped:", drops)
+		}
+	}
+	for i, queue := range c.handlers {
+		select {
+		case queue <- m:
+		default:
+			drops := atomic.AddInt64(&c.handlerDrops, 1)
+			c.log("WARNING: message handler", i, "is falling behind, dropped", describeMessage(m)+"; total dropped:", drops)
+		}
+	}
+	c.mu.Unlock()
+
+	// the client's own messages would answer themselves, as a bot replying
+	// to @all with @all does
+	if !m.IsOwn && mentioned(m.Body, c.mentionName()) {
+		select {
+		case c.mentions <- m:
+		default:
+			drops := atomic.AddInt64(&c.mentionDrops, 1)
+			c.log("WARNING: Mentions channel is full, dropped", describeMessage(m)+"; total dropped:", drops)
+		}
+	}
+}
+
+func (c *Client) notifySystem(m *Message) {
+	select {
+	case c.systemMessages <- m:
+	default:
+	}
+}
+
+func (c *Client) notifySubscription(s *Subscription) {
+	select {
+	case c.subscriptions <- s:
+	default:
+	}
+}
+
+func (c *Client) notifyMarker(m *Marker) {
+	select {
+	case c.markers <- m:
+	default:
+	}
+}
+
+func (c *Client) notifyError(m *Message) {
+	select {
+	case c.messageErrors <- m:
+	default:
+	}
+}
+
+func (c *Client) mentionName() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.mentionNames[c.jid]
+}
+
+// mentioned reports whether body contains @name, @all or @here.
+func mentioned(body, name string) bool {
+	for i := 0; i < len(body); i++ {
+		if body[i] != '@' || (i > 0 && isWordByte(body[i-1])) {
+			continue
+		}
+
+		j := i + 1
+		for j < len(body) && isWordByte(body[j]) {
+			j++
+		}
+
+		word := body[i+1 : j]
+		if strings.EqualFold(word, "all") || strings.EqualFold(word, "here") ||
+			(name != "" && strings.EqualFold(word, name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isWordByte reports whether b can be part of a mention name. Bytes of
+// multi-byte UTF-8 characters are treated as letters.
+func isWordByte(b byte) bool {
+	return b == '_' || b >= 0x80 ||
+		('0' <= b && b <= '9') || ('a' <= b && b <= 'z') || ('A' <= b && b <= 'Z')
+}
+
+func (c *Client) listen() {
+	var condition string // the last stream error sent by HipChat
+	for {
+		element, err := c.connection.Next()
+		if err != nil {
+			c.mu.Lock()
+			c.connected = false
+			if c.forced != nil {
+				err, c.forced = c.forced, nil
+			}
+			c.mu.Unlock()
+			c.failPending()
+			if condition == "conflict" && !c.config.retryConflict {
+				c.log("Replaced by another session with the same resource, not reconnecting")
+				c.stop(ErrConflict)
+			}
+			if c.closed() {
+				c.closeChannels()
+				return
+			}
+
+			// a successful reconnect starts a new listener
+			c.reconnect(err, condition)
+			return
+		}
+
+		switch element.Name.Local + element.Name.Space {
+		case "iq" + xmpp.NsJabberClient: // rooms and rosters
+			var iq *xmpp.IQ
+			if each := c.rosterStream(element); each != nil {
+				iq = c.connection.RosterStream(&element, func(jid, name, mentionName, subscription string, groups []string) {
+					u := newUser(jid, name, mentionName, subscription, groups)
+					c.updateMentionNames([]*User{u})
+					each(u)
+				})
+			} else {
+				iq = c.connection.IQ(&element)
+			}
+			if c.connection.Err() != nil {
+				continue // cut off, Next reports the error
+			}
+			if (iq.Type == "result" || iq.Type == "error") && c.reply(iq) {
+				continue
+			}
+			if iq.Type == "get" && iq.Ping != nil {
+				c.connection.Result(iq.From, iq.ID)
+				continue
+			}
+			if iq.Type == "get" && !c.config.noAutoReplies {
+				if iq.Time != nil {
+					c.connection.TimeResult(iq.From, iq.ID, time.Now())
+					continue
+				}
+				if iq.Query != nil && iq.Query.XMLName.Space == xmpp.NsIqVersion {
+					c.connection.VersionResult(iq.From, iq.ID, c.config.software, c.config.version)
+					continue
+				}
+			}
+			if iq.Query == nil {
+				continue
+			}
+
+			switch iq.Query.XMLName.Space {
+			case xmpp.NsIqRoster:
+				items := make([]*User, len(iq.Query.Items))
+				for i, item := range iq.Query.Items {
+					items[i] = newUser(item.Jid, item.Name, item.MentionName, item.Subscription, item.Groups)
+				}
+
+				// a roster push is sent with type set and must be acknowledged,
+				// unless it came from anyone but the server or the user's own
+				// account, which could only be spoofing it (RFC 6121 2.1.6)
+				if iq.Type == "set" {
+					if iq.From != "" && iq.From != c.JID() {
+						continue
+					}
+					c.connection.Result(iq.From, iq.ID)
+					for i, item := range iq.Query.Items {
+						update := &RosterUpdate{User: items[i], Removed: item.Subscription == "remove"}
+						if update.Removed {
+							c.removeMentionName(update.User)
+						} else {
+							c.updateMentionNames(items[i : i+1])
+						}
+
+						select {
+						case c.rosterUpdates <- update:
+						default:
+						}
+					}
+					continue
+				}
+
+				// the roster fetched on connect
+				c.updateMentionNames(items)
+				c.rosterOnce.Do(func() { close(c.rosterFetched) })
+			}
+		case "error" + xmpp.NsStream:
+			condition = c.connection.StreamError(&element).Condition
+		case "presence" + xmpp.NsJabberClient:
+			p := c.connection.ReadPresence(&element)
+			if c.connection.Err() != nil {
+				continue
+			}
+			switch {
+			case p.From == c.config.xmppDomain:
+				if p.Caps != nil && p.Type == "" {
+					c.mu.Lock()
+					c.serverCaps = p.Caps
+					c.mu.Unlock()
+					go c.resolveServerCaps(p.Caps)
+				}
+			case !c.isRoom(p.From):
+				switch p.Type {
+				case "subscribe", "subscribed", "unsubscribe", "unsubscribed":
+					c.notifySubscription(&Subscription{From: bareJID(p.From), Type: p.Type})
+				case "error":
+					c.notifySubscription(&Subscription{From: bareJID(p.From), Type: p.Type, Error: stanzaError(p.Error)})
+				default:
+					c.setStatus(bareJID(p.From), p.Type, p.Show, p.Status)
+				}
+			case p.Type == "error":
+				c.joinedRoom(bareJID(p.From), nil, stanzaError(p.Error))
+			default:
+				roomId := bareJID(p.From)
+				affiliation, role := p.Item()
+				presence := &RoomPresence{
+					Room:        roomId,
+					Nick:        strings.TrimPrefix(p.From[len(roomId):], "/"),
+					JID:         p.RealJID(),
+					Show:        p.Show,
+					Status:      p.Status,
+					Role:        role,
+					Affiliation: affiliation,
+					StatusCodes: p.StatusCodes(),
+					Time:        time.Now(),
+				}
+				presence.Joined = presence.Time
+				if sent := p.Sent(); !sent.IsZero() {
+					presence.Joined = sent
+				}
+				present := p.Type != "unavailable"
+				if !p.SelfPresence() {
+					c.occupantChanged(presence, present)
+				}
+				c.setOccupant(presence, present)
+				if p.SelfPresence() && present {
+					c.joinedRoom(roomId, p.StatusCodes(), nil)
+				}
+			}
+		case "message" + xmpp.NsJabberClient:
+			msg := c.connection.Message(&element)
+			if c.connection.Err() != nil {
+				continue
+			}
+			var carbon bool
+			// only the account itself may send carbons, anyone else is spoofing
+			if forwarded := msg.Carbon(); forwarded != nil && msg.From == c.JID() {
+				msg, carbon = forwarded, true
+			}
+			switch msg.Type {
+			case "groupchat", "chat":
+			case "error":
+				c.notifyError(&Message{
+					ID:    msg.ID,
+					Type:  msg.Type,
+					From:  msg.From,
+					To:    msg.To,
+					Body:  msg.Body,
+					Time:  time.Now(),
+					Error: stanzaError(msg.Error),
+				})
+				continue
+			case "headline", "normal", "":
+				if len(msg.Body) != 0 {
+					typ := msg.Type
+					if typ == "" {
+						typ = "normal"
+					}
+					c.notifySystem(&Message{
+						ID:   c.messageID(msg.Mid, msg.ID),
+						Type: typ,
+						From: msg.From,
+						To:   msg.To,
+						Body: msg.Body,
+						Time: time.Now(),
+					})
+				}
+				continue
+			default:
+				continue
+			}
+
+			if msg.Subject != nil && msg.Type == "groupchat" {
+				setter := topicSetter{at: time.Now()}
+				if i := strings.Index(msg.From, "/"); i != -1 {
+					setter.nick = msg.From[i+1:]
+				}
+				if msg.Delay != nil {
+					if t, err := time.Parse(time.RFC3339Nano, msg.Delay.Stamp); err == nil {
+						setter.at = t
+					}
+				}
+				c.setTopic(bareJID(msg.From), *msg.Subject, setter)
+			}
+
+			if typ, id := msg.Marker(); typ != "" {
+				c.notifyMarker(&Marker{
+					ID:   id,
+					Type: typ,
+					From: msg.From,
+					To:   msg.To,
+					Time: time.Now(),
+				})
+			}
+
+			// empty body indicates a toggle in typing status
+			if len(msg.Body) == 0 {
+				continue
+			}
+
+			m := &Message{
+				ID:   c.messageID(msg.Mid, msg.ID),
+				Type: msg.Type,
+				From: msg.From,
+				To:   msg.To,
+				Body: msg.Body,
+				Time: time.Now(),
+			}
+			c.identifySender(m)
+			m.IsOwn = c.isOwn(m.Type, m.From)
+			if m.IsOwn && m.Type == "groupchat" {
+				c.echoed(msg.ID)
+			}
+			m.Carbon = carbon
+			if c.config.emoticons != nil {
+				m.Body = ReplaceEmoticons(m.Body, c.config.emoticons)
+			}
+			if msg.Markable != nil {
+				m.Markable = true
+			}
+			if msg.Replace != nil {
+				m.Replaces = msg.Replace.ID
+			}
+			if msg.Reply != nil {
+				m.ReplyTo = msg.Reply.ID
+			}
+			if card := msg.Card; card != nil {
+				m.Card = &Card{
+					Style:       card.Style,
+					Title:       card.Title,
+					Description: card.Description,
+					URL:         card.URL,
+					Icon:        card.Icon.URL,
+					Thumbnail:   card.Thumbnail.URL,
+					Activity:    card.Activity.HTML,
+				}
+				if card.Style == "link" {
+					m.Link = &LinkPreview{
+						URL:         card.URL,
+						Title:       card.Title,
+						Description: card.Description,
+						Image:       card.Thumbnail.URL,
+						Icon:        card.Icon.URL,
+					}
+				}
+			}
+			if file := msg.File; file != nil {
+				m.File = &FileShare{
+					Name:         file.Name,
+					URL:          file.URL,
+					Size:         file.Size,
+					ThumbnailURL: file.ThumbURL,
+				}
+			}
+			if msg.Delay != nil {
+				if t, err := time.Parse(time.RFC3339Nano, msg.Delay.Stamp); err == nil {
+					m.Time = t
+					m.Delayed = true
+				}
+			}
+			if m.Type == "groupchat" {
+				c.seen(bareJID(m.From), m.Time)
+			}
+			c.acknowledge(msg.ID, msg.ReceiptRequest != nil, m)
+			c.deliver(m)
+		}
+	}
+}
+
+var localIDs int64
+
+// acknowledge sends the acknowledgements of m that the AckPolicy calls for.
+// id is the id of the message's stanza, which acknowledgements refer to.
+func (c *Client) acknowledge(id string, receiptRequested bool, m *Message) {
+	acks := c.config.acks
+	if id == "" || m.IsOwn || m.Carbon || m.Delayed {
+		return
+	}
+	if acks.Receipts && receiptRequested && m.Type == "chat" {
+		c.connection.Receipt(m.From, c.JID(), id)
+	}
+	if acks.Markers && m.Markable {
+		c.mark(m.From, "received", id)
+	}
+}
+
+// identifySender fills in the fields of m describing its sender from the room
+// occupants and the roster.
+func (c *Client) identifySender(m *Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if m.Type == "groupchat" {
+		m.Room = bareJID(m.From)
+		m.Nick = strings.TrimPrefix(m.From[len(m.Room):], "/")
+		if p, ok := c.occupants[m.Room][m.Nick]; ok && p.JID != "" {
+			m.SenderJID = bareJID(p.JID)
+		}
+	} else {
+		m.SenderJID = bareJID(m.From)
+	}
+	if m.SenderJID != "" {
+		m.Name = c.names[m.SenderJID]
+		m.MentionName = c.mentionNames[m.SenderJID]
+	}
+	if m.Name == "" {
+		m.Name = m.Nick
+	}
+}
+
+// describeMessage names the sender of m, and the room it was sent in, for
+// logging.
+func describeMessage(m *Message) string {
+	if m.Room == "" {
+		return "message from " + m.From
+	}
+	if m.SenderJID != "" {
+		return "message from " + m.Nick + " (" + m.SenderJID + ") in " + m.Room
+	}
+	return "message from " + m.Nick + " in " + m.Room
+}
+
+// messageID returns the id to give a received message, see Message.
+func (c *Client) messageID(mid, id string) string {
+	if mid != "" {
+		return mid
+	}
+	if id != "" {
+		return id
+	}
+	if c.config.ids != nil {
+		return c.config.ids.NewID()
+	}
+	return fmt.Sprintf("local-%d", atomic.AddInt64(&localIDs, 1))
+}
+
+// isOwn reports whether a message of type typ from the given JID was sent by
+// the client's account: from any of its sessions in a chat, or under the name
+// it joined with in a room.
+func (c *Client) isOwn(typ, from string) bool {
+	if typ != "groupchat" {
+		return bareJID(from) == c.JID()
+	}
+
+	roomId := bareJID(from)
+	c.mu.Lock()
+	resource, ok := c.joined[roomId]
+	c.mu.Unlock()
+	return ok && from == roomId+"/"+resource
+}
+
+// isRoom reports whether jid belongs to a room rather than a user.
+func (c *Client) isRoom(jid string) bool {
+	return strings.HasSuffix(bareJID(jid), "@"+c.config.confDomain)
+}
+
+// bareJID strips the resource from jid.
+func bareJID(jid string) string {
+	if i := strings.Index(jid, "/"); i != -1 {
+		return jid[:i]
 	}
+	return jid
 }
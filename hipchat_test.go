@@ -0,0 +1,1546 @@
+package hipchat
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mackross/go-hipchat/hipchattest"
+	"github.com/mackross/go-hipchat/xmpp"
+)
+
+// connect returns a client logged in to server, which is disconnected when
+// the test ends.
+func connect(t *testing.T, server *hipchattest.Server, opts ...Option) *Client {
+	t.Helper()
+	opts = append([]Option{WithTransport(server), WithDisableTLS(), WithLogger(nil)}, opts...)
+	c, err := NewClient("user", "pass", "bot", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Disconnect() })
+	return c
+}
+
+// chat returns a chat from a user to the client, as the server sends it.
+func chat(body string) string {
+	return fmt.Sprintf("<message from='1_2@chat.hipchat.com/web' to='user@chat.hipchat.com/bot' type='chat' id='%s'><body>%s</body></message>", body, body)
+}
+
+// groupchat returns a message sent to a room by nick, as the room sends it.
+func groupchat(roomId, nick, body string) string {
+	return fmt.Sprintf("<message from='%s/%s' to='user@chat.hipchat.com/bot' type='groupchat' id='%s'><body>%s</body></message>", roomId, nick, body, body)
+}
+
+func receive(t *testing.T, messages <-chan *Message) *Message {
+	t.Helper()
+	select {
+	case m, ok := <-messages:
+		if !ok {
+			t.Fatal("channel closed")
+		}
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+		return nil
+	}
+}
+
+func TestRoomsWhileMessagesUnread(t *testing.T) {
+	// the rooms arrive behind more messages than Messages buffers, which
+	// nobody reads while waiting for them
+	rooms := "<iq id='{{id}}' type='result' from='conf.hipchat.com'><query xmlns='http://jabber.org/protocol/disco#items'><item jid='1_dev@conf.hipchat.com' name='Dev'/></query></iq>"
+	server := hipchattest.NewServer(append(hipchattest.Login(),
+		hipchattest.Step{Expect: "disco#items", Reply: chat("1") + chat("2") + chat("3") + rooms},
+	)...)
+	c := connect(t, server, WithMessageBuffer(1))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	got, err := c.RoomsContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Id != "1_dev@conf.hipchat.com" {
+		t.Errorf("RoomsContext() = %+v", got)
+	}
+	if m := receive(t, c.Messages()); m.Body != "1" {
+		t.Errorf("first message = %q, want the one buffered", m.Body)
+	}
+}
+
+// ping is a ping from the server, which the client must answer.
+const ping = "<iq type='get' id='ping1' from='chat.hipchat.com' to='user@chat.hipchat.com/bot'><ping xmlns='urn:xmpp:ping'/></iq>"
+
+// waitFor fails the test unless cond becomes true within a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatal("timed out waiting for " + what)
+}
+
+func TestListenWhileMessagesUnread(t *testing.T) {
+	server := hipchattest.NewServer(append(hipchattest.Login(),
+		hipchattest.Step{Reply: chat("1") + chat("2") + chat("3") + chat("4") + ping},
+		hipchattest.Step{Expect: "id='ping1'"},
+	)...)
+	c := connect(t, server, WithMessageBuffer(2))
+
+	// the listener answers the ping behind the messages nobody reads
+	waitFor(t, "the ping to be answered", func() bool {
+		received := server.Received()
+		return strings.Contains(received[len(received)-1], "id='ping1'")
+	})
+	if err := server.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if drops := c.Stats().MessageDrops; drops != 2 {
+		t.Errorf("MessageDrops = %d, want 2", drops)
+	}
+	for _, want := range []string{"1", "2"} {
+		if m := receive(t, c.Messages()); m.Body != want {
+			t.Errorf("received %q, want %q", m.Body, want)
+		}
+	}
+}
+
+func TestClientsWithDifferentDomains(t *testing.T) {
+	rooms := "<iq id='{{id}}' type='result'><query xmlns='http://jabber.org/protocol/disco#items'/></iq>"
+	cloud := hipchattest.NewServer(append(hipchattest.Login(),
+		hipchattest.Step{Expect: "to='conf.hipchat.com'", Reply: rooms},
+		hipchattest.Step{Reply: chat("cloud")},
+	)...)
+	onPrem := hipchattest.NewServer(append(hipchattest.Login(),
+		hipchattest.Step{Expect: "to='conf.chat.example.com'", Reply: rooms},
+		hipchattest.Step{Reply: chat("on-prem")},
+	)...)
+	a := connect(t, cloud)
+	b := connect(t, onPrem, WithXMPPDomain("chat.example.com"))
+
+	if a.Id != "user@chat.hipchat.com" || b.Id != "user@chat.example.com" {
+		t.Errorf("Ids = %s, %s", a.Id, b.Id)
+	}
+	if _, err := a.Rooms(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Rooms(); err != nil {
+		t.Fatal(err)
+	}
+	if m := receive(t, a.Messages()); m.Body != "cloud" {
+		t.Errorf("cloud client received %q", m.Body)
+	}
+	if m := receive(t, b.Messages()); m.Body != "on-prem" {
+		t.Errorf("on-prem client received %q", m.Body)
+	}
+
+	for server, domain := range map[*hipchattest.Server]string{cloud: "chat.hipchat.com", onPrem: "chat.example.com"} {
+		if err := server.Err(); err != nil {
+			t.Error(err)
+		}
+		if stream := server.Received()[0]; !strings.Contains(stream, "to='"+domain+"'") {
+			t.Errorf("stream opened with %s, want it to %s", stream, domain)
+		}
+	}
+}
+
+func TestDropKeepsChannels(t *testing.T) {
+	server := hipchattest.NewServer(append(hipchattest.Login(), hipchattest.Step{Reply: chat("before")})...).
+		Then(append(hipchattest.Login(), hipchattest.Step{Reply: chat("after")})...)
+	c := connect(t, server)
+	messages := c.Messages()
+	if m := receive(t, messages); m.Body != "before" {
+		t.Fatalf("received %q", m.Body)
+	}
+
+	server.Drop()
+	select {
+	case info := <-c.OnReconnect():
+		if info.Count != 1 || info.Err == nil {
+			t.Errorf("OnReconnect() = %+v", info)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("did not reconnect")
+	}
+	if c.Messages() != messages {
+		t.Error("Messages() returned a new channel after reconnecting")
+	}
+	if m := receive(t, messages); m.Body != "after" {
+		t.Errorf("received %q after reconnecting", m.Body)
+	}
+	if err := server.Err(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDisconnectWhileReconnecting(t *testing.T) {
+	server := hipchattest.NewServer(hipchattest.Login()...).Then(hipchattest.Login()...)
+	c := connect(t, server)
+	messages := c.Messages()
+
+	server.Drop()
+	time.Sleep(50 * time.Millisecond) // into the delay before reconnecting
+	c.Disconnect()
+	select {
+	case _, ok := <-messages:
+		if ok {
+			t.Error("received a message")
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("Messages not closed while waiting to reconnect")
+	}
+}
+
+func TestForceDisconnect(t *testing.T) {
+	server := hipchattest.NewServer(hipchattest.Login()...).
+		Then(append(hipchattest.Login(), hipchattest.Step{Reply: chat("after")})...)
+	c := connect(t, server)
+
+	forced := errors.New("forced")
+	c.forceDisconnect(forced)
+	select {
+	case info := <-c.OnReconnect():
+		if info.Err != forced {
+			t.Errorf("reconnected after %v, want the forced error", info.Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("did not reconnect")
+	}
+	if m := receive(t, c.Messages()); m.Body != "after" {
+		t.Errorf("received %q after reconnecting", m.Body)
+	}
+}
+
+const (
+	stream    = "<?xml version='1.0'?><stream:stream from='chat.hipchat.com' id='stream' version='1.0' xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams'>"
+	starttls  = "<starttls xmlns='urn:ietf:params:xml:ns:xmpp-tls'><required/></starttls>"
+	anonymous = "<mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><mechanism>ANONYMOUS</mechanism></mechanisms>"
+	bind      = "<bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/>"
+	bound     = "<iq id='{{id}}' type='result'><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'><jid>anon1@chat.hipchat.com/bot</jid></bind></iq>"
+	success   = "<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>"
+)
+
+func features(features ...string) string {
+	return "<stream:features>" + strings.Join(features, "") + "</stream:features>"
+}
+
+// handshake returns the steps of the handshake trace, without their details.
+func handshake(c *Client) string {
+	var steps []string
+	for _, s := range c.Handshake() {
+		steps = append(steps, s.Step)
+	}
+	return strings.Join(steps, " ")
+}
+
+func TestStartTLSThenBind(t *testing.T) {
+	cert, roots := hipchattest.NewCertificate("chat.hipchat.com")
+	server := hipchattest.NewServer(
+		hipchattest.Step{Expect: "<stream:stream", Reply: stream + features(starttls, anonymous)},
+		hipchattest.StartTLS(cert),
+		hipchattest.Step{Expect: "<stream:stream", Reply: stream + features(anonymous)},
+		hipchattest.Step{Expect: "mechanism='ANONYMOUS'", Reply: success},
+		hipchattest.Step{Expect: "<stream:stream", Reply: stream + features(bind)},
+		hipchattest.Step{Expect: "<resource>bot</resource>", Reply: bound},
+	)
+	c, err := NewClient("", "", "bot", WithTransport(server), WithRootCAs(roots), WithAnonymous())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Disconnect()
+
+	if err := server.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := "stream features starttls tls stream features auth success stream features bind bound"
+	if got := handshake(c); got != want {
+		t.Errorf("handshake %s, want %s", got, want)
+	}
+	if !c.IsSecure() || c.FullJID() != "anon1@chat.hipchat.com/bot" {
+		t.Errorf("IsSecure() = %v, FullJID() = %s after binding", c.IsSecure(), c.FullJID())
+	}
+}
+
+func TestAnonymousJID(t *testing.T) {
+	login := func(jid string) []hipchattest.Step {
+		return []hipchattest.Step{
+			{Expect: "<stream:stream to=", Reply: stream + features(anonymous)},
+			{Expect: "mechanism='ANONYMOUS'", Reply: success},
+			{Expect: "<stream:stream", Reply: stream + features(bind)},
+			{Expect: "<resource>bot</resource>", Reply: strings.Replace(bound, "anon1@", jid+"@", 1)},
+		}
+	}
+	// each login opens its stream from no one, and is assigned a new JID
+	server := hipchattest.NewServer(append(login("anon1"),
+		hipchattest.Step{Expect: "from='anon1@chat.hipchat.com'"},
+	)...).Then(append(login("anon2"),
+		hipchattest.Step{Expect: "from='anon2@chat.hipchat.com'"},
+	)...)
+	c, err := NewClient("", "", "bot", WithTransport(server), WithDisableTLS(), WithAnonymous())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Disconnect()
+
+	if c.Id != "" || c.JID() != "anon1@chat.hipchat.com" {
+		t.Errorf("Id = %q, JID() = %q after binding", c.Id, c.JID())
+	}
+	if err := c.Status("chat"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the presence", func() bool { return len(server.Received()) == 5 })
+
+	server.Drop()
+	reconnected(t, c)
+	if c.JID() != "anon2@chat.hipchat.com" {
+		t.Errorf("JID() = %q after reconnecting", c.JID())
+	}
+	waitFor(t, "the presence", func() bool { return len(server.Received()) == 10 })
+	if err := server.Err(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTruncatedStanzaReconnectsOnce(t *testing.T) {
+	server := hipchattest.NewServer(append(hipchattest.Login(),
+		hipchattest.Step{Reply: "<message from='1_2@chat.hipchat.com/web' type='chat'><body>cut o", Close: true},
+	)...).Then(append(hipchattest.Login(), hipchattest.Step{Reply: chat("after")})...)
+	c := connect(t, server)
+
+	if m := receive(t, c.Messages()); m.Body != "after" {
+		t.Errorf("received %q, want only the message after reconnecting", m.Body)
+	}
+	select {
+	case info := <-c.OnReconnect():
+		if info.Count != 1 || info.Attempts != 1 {
+			t.Errorf("OnReconnect() = %+v, want the first reconnect at the first attempt", info)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("did not report reconnecting")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	var streams int
+	for _, stanza := range server.Received() {
+		if strings.HasPrefix(stanza, "<stream:stream") {
+			streams++
+		}
+	}
+	if streams != 2 {
+		t.Errorf("opened %d streams, want 2", streams)
+	}
+	if err := server.Err(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStreamRestarts(t *testing.T) {
+	// the server offers everything on every stream, so only what the client
+	// has negotiated so far tells it what to do next
+	all := stream + features(starttls, anonymous, bind)
+	cert, roots := hipchattest.NewCertificate("chat.hipchat.com")
+	server := hipchattest.NewServer(
+		hipchattest.Step{Expect: "<stream:stream", Reply: all},
+		hipchattest.StartTLS(cert),
+		hipchattest.Step{Expect: "<stream:stream", Reply: all},
+		hipchattest.Step{Expect: "mechanism='ANONYMOUS'", Reply: success},
+		hipchattest.Step{Expect: "<stream:stream", Reply: all},
+		hipchattest.Step{Expect: "<resource>bot</resource>", Reply: bound},
+	)
+	c, err := NewClient("", "", "bot", WithTransport(server), WithRootCAs(roots), WithAnonymous())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Disconnect()
+
+	if err := server.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := "stream features starttls tls stream features auth success stream features bind bound"
+	if got := handshake(c); got != want {
+		t.Errorf("handshake %s, want %s", got, want)
+	}
+}
+
+func TestWhitespaceBetweenStanzas(t *testing.T) {
+	// the connection is unbuffered, so whitespace is only sent on its own
+	// once the client is listening, and with replies during the handshake
+	login := hipchattest.Login()
+	for i := range login {
+		login[i].Reply += " \n "
+	}
+	server := hipchattest.NewServer(
+		login[0],
+		login[1],
+		login[2],
+		hipchattest.KeepAlive(),
+		hipchattest.Step{Reply: chat("1") + "\n\n" + chat("2") + " \t "},
+		hipchattest.KeepAlive(),
+		hipchattest.Step{Reply: ping},
+		hipchattest.Step{Expect: "id='ping1'"},
+	)
+	c := connect(t, server)
+
+	for _, want := range []string{"1", "2"} {
+		if m := receive(t, c.Messages()); m.Body != want {
+			t.Errorf("received %q, want %q", m.Body, want)
+		}
+	}
+	waitFor(t, "the ping to be answered", func() bool {
+		received := server.Received()
+		return strings.Contains(received[len(received)-1], "id='ping1'")
+	})
+	if err := server.Err(); err != nil {
+		t.Error(err)
+	}
+	select {
+	case info := <-c.OnReconnect():
+		t.Errorf("reconnected after %v", info.Err)
+	default:
+	}
+}
+
+func TestWhitespaceAfterStreamRestart(t *testing.T) {
+	server := hipchattest.NewServer(
+		hipchattest.Step{Expect: "<stream:stream", Reply: stream + " \n " + features(anonymous)},
+		hipchattest.Step{Expect: "mechanism='ANONYMOUS'", Reply: success + " "},
+		hipchattest.Step{Expect: "<stream:stream", Reply: stream + "\n  " + features(bind) + " "},
+		hipchattest.Step{Expect: "<resource>bot</resource>", Reply: bound},
+		hipchattest.KeepAlive(),
+		hipchattest.Step{Reply: ping},
+		hipchattest.Step{Expect: "id='ping1'"},
+	)
+	c, err := NewClient("", "", "bot", WithTransport(server), WithDisableTLS(), WithAnonymous())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Disconnect()
+
+	waitFor(t, "the ping to be answered", func() bool {
+		received := server.Received()
+		return strings.Contains(received[len(received)-1], "id='ping1'")
+	})
+	if err := server.Err(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPresenceRefresh(t *testing.T) {
+	server := hipchattest.NewServer(hipchattest.Login()...)
+	c := connect(t, server, WithPresenceRefresh(10*time.Millisecond))
+
+	const room = "1_dev@conf.hipchat.com"
+	if err := c.Join(room, "Bot"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetRoomPresence(room, "Bot", "away", "lunch"); err != nil {
+		t.Fatal(err)
+	}
+
+	// count presences to the room, ignoring any refreshes sent before
+	// SetRoomPresence
+	count := func(s string) int {
+		n := 0
+		for _, stanza := range server.Received() {
+			if strings.Contains(stanza, room+"/Bot") && strings.Contains(stanza, s) {
+				n++
+			}
+		}
+		return n
+	}
+	waitFor(t, "a refresh", func() bool { return count("<show>away</show><status>lunch</status>") >= 2 })
+	if joins := count("http://jabber.org/protocol/muc"); joins != 1 {
+		t.Errorf("joined %d times, want 1", joins)
+	}
+	if err := server.Err(); err != nil {
+		t.Error(err)
+	}
+}
+
+// logBuffer collects what a logger writes, for reading while it writes.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestDropsCounted(t *testing.T) {
+	server := hipchattest.NewServer(append(hipchattest.Login(),
+		hipchattest.Step{Reply: chat("!a @all") + chat("!b @all") + chat("!c @all")},
+	)...)
+	logged := new(logBuffer)
+	c := connect(t, server, WithMessageBuffer(1), WithMentionBuffer(1), WithLogger(log.New(logged, "", 0)))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.MessagesContext(ctx)
+	c.Commands("!")
+
+	// nothing reads, so each channel keeps the first message and drops the
+	// rest; a command is dropped either by its handler or by its channel
+	waitFor(t, "the drops", func() bool {
+		s := c.Stats()
+		return s.MessageDrops == 2 && s.ContextDrops == 2 && s.MentionDrops == 2 && s.HandlerDrops+s.CommandDrops == 2
+	})
+	waitFor(t, "a warning for each drop", func() bool {
+		return strings.Count(logged.String(), "dropped message from 1_2@chat.hipchat.com/web") == 8
+	})
+}
+
+func TestSystemMessageTypes(t *testing.T) {
+	server := hipchattest.NewServer(append(hipchattest.Login(),
+		hipchattest.Message("headline", "chat.hipchat.com", "user@chat.hipchat.com/bot", "maintenance"),
+		hipchattest.Message("normal", "chat.hipchat.com", "user@chat.hipchat.com/bot", "notice"),
+		hipchattest.Step{Reply: "<message from='chat.hipchat.com' to='user@chat.hipchat.com/bot'><body>untyped</body></message>"},
+	)...)
+	c := connect(t, server)
+
+	for _, want := range []string{"headline", "normal", "normal"} {
+		if m := receive(t, c.SystemMessages()); m.Type != want {
+			t.Errorf("%q has Type %q, want %q", m.Body, m.Type, want)
+		}
+	}
+}
+
+func TestLastActivityContext(t *testing.T) {
+	server := hipchattest.NewServer(append(hipchattest.Login(),
+		hipchattest.Step{Expect: "jabber:iq:last", Reply: "<iq id='{{id}}' type='result' from='1_2@chat.hipchat.com'><query xmlns='jabber:iq:last' seconds='90'/></iq>"},
+		hipchattest.Step{Expect: "jabber:iq:last"},
+	)...)
+	c := connect(t, server)
+
+	idle, err := c.LastActivityContext(context.Background(), "1_2@chat.hipchat.com")
+	if err != nil || idle != 90*time.Second {
+		t.Errorf("LastActivityContext() = %v, %v, want 1m30s", idle, err)
+	}
+
+	// the second query is never answered
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.LastActivityContext(ctx, "1_2@chat.hipchat.com"); err != context.DeadlineExceeded {
+		t.Errorf("LastActivityContext() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// memStore is a Store that counts the times it saves.
+type memStore struct {
+	mu    sync.Mutex
+	times map[string]time.Time
+	saves int
+}
+
+func (s *memStore) Load(roomId string) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.times[roomId], nil
+}
+
+func (s *memStore) Save(roomId string, lastSeen time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.times[roomId] = lastSeen
+	s.saves++
+	return nil
+}
+
+func TestStoreSavedOnDisconnect(t *testing.T) {
+	const room = "1_dev@conf.hipchat.com"
+	var steps []hipchattest.Step
+	for _, body := range []string{"1", "2", "3"} {
+		steps = append(steps, hipchattest.Message("groupchat", room+"/alice", "user@chat.hipchat.com/bot", body))
+	}
+	server := hipchattest.NewServer(append(hipchattest.Login(), steps...)...)
+	store := &memStore{times: make(map[string]time.Time)}
+	c := connect(t, server, WithStore(store))
+
+	var last *Message
+	for i := 0; i < 3; i++ {
+		last = receive(t, c.Messages())
+	}
+	// Disconnect saves what is left without waiting for the delay
+	c.Disconnect()
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.saves != 1 || !store.times[room].Equal(last.Time) {
+		t.Errorf("saved %d times, last seen %v, want once at %v", store.saves, store.times[room], last.Time)
+	}
+}
+
+func TestStreamUsersWhileUnread(t *testing.T) {
+	roster := "<iq id='{{id}}' type='result'><query xmlns='jabber:iq:roster'>" +
+		"<item jid='1_2@chat.hipchat.com' name='Alice' mention_name='alice' subscription='both'/>" +
+		"<item jid='1_3@chat.hipchat.com' name='Bob' mention_name='bob' subscription='both'/>" +
+		"</query></iq>"
+	server := hipchattest.NewServer(append(hipchattest.Login(),
+		hipchattest.Step{Expect: "jabber:iq:roster", Reply: roster + chat("after")},
+	)...)
+	c := connect(t, server)
+
+	users := make(chan *User)
+	errs := make(chan error, 1)
+	go func() { errs <- c.StreamUsers(context.Background(), users) }()
+
+	// the message behind the roster arrives while nobody reads users
+	if m := receive(t, c.Messages()); m.Body != "after" {
+		t.Errorf("received %q", m.Body)
+	}
+	for _, want := range []string{"alice", "bob"} {
+		select {
+		case u := <-users:
+			if u.MentionName != want {
+				t.Errorf("received %s, want %s", u.MentionName, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no user received")
+		}
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCloseWhileWriteStalled(t *testing.T) {
+	defer func(d time.Duration) { closeTimeout = d }(closeTimeout)
+	closeTimeout = 100 * time.Millisecond
+
+	server := hipchattest.NewServer(append(hipchattest.Login(), hipchattest.Step{Stall: true})...)
+	defer server.Drop()
+	c := connect(t, server)
+
+	said := make(chan error, 1)
+	go func() { said <- c.Say("1_2@chat.hipchat.com", "Bot", "stuck") }()
+	time.Sleep(50 * time.Millisecond) // let Say start writing
+
+	closed := make(chan error, 1)
+	go func() { closed <- c.Close() }()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not give up on the stalled connection")
+	}
+	if err := <-said; err == nil {
+		t.Error("Say succeeded on a stalled connection")
+	}
+}
+
+func TestConnectionInfoDuringTLSReconnect(t *testing.T) {
+	cert, roots := hipchattest.NewCertificate("chat.hipchat.com")
+	server := hipchattest.NewServer(hipchattest.TLSLogin(cert)...).Then(hipchattest.TLSLogin(cert)...)
+	c, err := NewClient("user", "pass", "bot", WithTransport(server), WithRootCAs(roots))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Disconnect()
+
+	// read the connection while the reconnect negotiates TLS, for the race
+	// detector to check
+	stop := make(chan struct{})
+	polled := make(chan struct{})
+	go func() {
+		defer close(polled)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				c.ConnectionInfo()
+				c.IsSecure()
+			}
+		}
+	}()
+	server.Drop()
+	select {
+	case <-c.OnReconnect():
+	case <-time.After(5 * time.Second):
+		t.Fatal("did not reconnect")
+	}
+	close(stop)
+	<-polled
+	if info := c.ConnectionInfo(); !info.TLS {
+		t.Errorf("ConnectionInfo() = %+v after reconnecting", info)
+	}
+	for _, s := range c.Handshake() {
+		if s.Step == "tls" && !strings.HasPrefix(s.Detail, "TLS 1.") {
+			t.Errorf("tls step detail = %q", s.Detail)
+		}
+	}
+}
+
+func TestSplitMessage(t *testing.T) {
+	a, b := strings.Repeat("a", 10), strings.Repeat("b", 15)
+	tests := []struct {
+		name string
+		body string
+		max  int
+		want []string
+	}{
+		{"short", "hello", 10, []string{"hello"}},
+		{"empty", "", 10, nil},
+		{"no limit", a + b, 0, []string{a + b}},
+		{"at newline", "aaa\nbbb\nccc", 8, []string{"aaa\nbbb", "ccc"}},
+		{"newline after full chunk", a + "\n" + b, 10, []string{a, b[:10], b[10:]}},
+		{"newline after hard split", a + "a\n" + b, 10, []string{a, "a", b[:10], b[10:]}},
+		{"blank lines", "aaa\n\n\nbbb", 4, []string{"aaa\n", "\nbbb"}},
+		{"hard split", a + b, 10, []string{a, b[:10], b[10:]}},
+		{"whole runes", "ééééé", 5, []string{"éé", "éé", "é"}},
+		{"rune longer than max", "€€", 2, []string{"€", "€"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := splitMessage(test.body, test.max)
+			if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", test.want) {
+				t.Errorf("splitMessage(%q, %d) = %q, want %q", test.body, test.max, got, test.want)
+			}
+		})
+	}
+}
+
+func TestSayLong(t *testing.T) {
+	server := hipchattest.NewServer(append(hipchattest.Login(),
+		hipchattest.Step{Expect: "<body>first line</body>"},
+		hipchattest.Step{Expect: "<body>second</body>"},
+	)...)
+	c := connect(t, server, WithMaxMessageLength(11), WithSendInterval(50*time.Millisecond))
+
+	start := time.Now()
+	if err := c.SayLong("1_2@chat.hipchat.com", "Bot", "first line\nsecond"); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("sent both messages within %v", elapsed)
+	}
+	waitFor(t, "both messages", func() bool { return len(server.Received()) == 5 })
+	if err := server.Err(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOwnMessagesAreNotMentions(t *testing.T) {
+	const room = "1_dev@conf.hipchat.com"
+	server := hipchattest.NewServer(append(hipchattest.Login(),
+		hipchattest.Step{Expect: room + "/Bot"},
+		hipchattest.Message("groupchat", room+"/Bot", "user@chat.hipchat.com/bot", "@all own"),
+		hipchattest.Message("groupchat", room+"/alice", "user@chat.hipchat.com/bot", "@all other"),
+	)...)
+	c := connect(t, server)
+	if err := c.Join(room, "Bot"); err != nil {
+		t.Fatal(err)
+	}
+
+	if m := receive(t, c.Mentions()); m.Body != "@all other" {
+		t.Errorf("mentioned by %q", m.Body)
+	}
+	if m := receive(t, c.Messages()); m.Body != "@all own" || !m.IsOwn {
+		t.Errorf("received %+v, want the own message on Messages", m)
+	}
+}
+
+func TestBufferSizesAtLeastOne(t *testing.T) {
+	server := hipchattest.NewServer(append(hipchattest.Login(), hipchattest.Step{Reply: chat("kept")})...)
+	c := connect(t, server, WithMessageBuffer(-1), WithHandlerBuffer(0), WithMentionBuffer(-5))
+	if m := receive(t, c.Messages()); m.Body != "kept" {
+		t.Errorf("received %q", m.Body)
+	}
+}
+
+func TestStreamUsersBackpressure(t *testing.T) {
+	var items strings.Builder
+	for i := 0; i < userStreamBuffer+10; i++ {
+		fmt.Fprintf(&items, "<item jid='1_%d@chat.hipchat.com' name='User %d' subscription='both'/>", i, i)
+	}
+	roster := "<iq id='{{id}}' type='result'><query xmlns='jabber:iq:roster'>" + items.String() + "</query></iq>"
+	server := hipchattest.NewServer(append(hipchattest.Login(),
+		hipchattest.Step{Expect: "jabber:iq:roster", Reply: roster + chat("after")},
+	)...)
+	c := connect(t, server)
+
+	users := make(chan *User)
+	errs := make(chan error, 1)
+	go func() { errs <- c.StreamUsers(context.Background(), users) }()
+
+	// the roster does not fit the queue, so nothing behind it is received
+	// until users is read
+	select {
+	case m := <-c.Messages():
+		t.Fatalf("received %q before reading users", m.Body)
+	case <-time.After(100 * time.Millisecond):
+	}
+	for i := 0; i < userStreamBuffer+10; i++ {
+		<-users
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if m := receive(t, c.Messages()); m.Body != "after" {
+		t.Errorf("received %q", m.Body)
+	}
+}
+
+// selfPresence returns the presence a room sends the client once it has
+// joined under nick.
+func selfPresence(roomId, nick string) string {
+	return "<presence from='" + roomId + "/" + nick + "' to='user@chat.hipchat.com/bot'>" +
+		"<x xmlns='http://jabber.org/protocol/muc#user'><item affiliation='member' role='participant'/>" +
+		"<status code='110'/></x></presence>"
+}
+
+func reconnected(t *testing.T, c *Client) {
+	t.Helper()
+	select {
+	case <-c.OnReconnect():
+	case <-time.After(5 * time.Second):
+		t.Fatal("did not reconnect")
+	}
+}
+
+func TestJoinAll(t *testing.T) {
+	const dev, ops = "1_dev@conf.hipchat.com", "1_ops@conf.hipchat.com"
+	server := hipchattest.NewServer(append(hipchattest.Login(),
+		hipchattest.Step{Expect: "<password>secret</password>", Reply: selfPresence(dev, "Bot")},
+		hipchattest.Step{Expect: ops + "/Bot"},
+		hipchattest.Step{Expect: "unavailable"},
+	)...).Then(append(hipchattest.Login(),
+		// rejoined with the password JoinAll was given
+		hipchattest.Step{Expect: "<password>secret</password>"},
+		hipchattest.Step{Expect: dev + "/Bot"},
+	)...).Then(append(hipchattest.Login(),
+		hipchattest.Step{Expect: dev + "/Bot"},
+	)...)
+	c := connect(t, server, WithSendInterval(50*time.Millisecond))
+
+	start := time.Now()
+	errs := c.JoinAll([]RoomJoin{
+		{RoomId: dev, Nick: "Bot", Password: "secret", Wait: true},
+		{RoomId: ops, Nick: "Bot"},
+	})
+	if len(errs) != 0 {
+		t.Fatalf("JoinAll() = %v", errs)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("JoinAll sent both joins within %v", d)
+	}
+	if state, err := c.JoinState(dev); state != JoinConfirmed || err != nil {
+		t.Errorf("JoinState(dev) = %v, %v", state, err)
+	}
+	if err := c.Leave(ops, "Bot"); err != nil {
+		t.Fatal(err)
+	}
+
+	server.Drop()
+	reconnected(t, c)
+	// a plain Join forgets the password
+	if err := c.Join(dev, "Bot"); err != nil {
+		t.Fatal(err)
+	}
+	server.Drop()
+	reconnected(t, c)
+
+	var last string
+	waitFor(t, "the rejoin", func() bool {
+		received := server.Received()
+		last = received[len(received)-1]
+		return strings.Contains(last, dev+"/Bot")
+	})
+	if strings.Contains(last, "password") {
+		t.Errorf("rejoined with %q", last)
+	}
+	if err := server.Err(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWithJoin(t *testing.T) {
+	const dev, ops = "1_dev@conf.hipchat.com", "1_ops@conf.hipchat.com"
+	server := hipchattest.NewServer(append(hipchattest.Login(),
+		// joined in the order given, one at a time
+		hipchattest.Step{Expect: ops + "/Bot", Reply: selfPresence(ops, "Bot")},
+		hipchattest.Step{Expect: dev + "/Bot", Reply: selfPresence(dev, "Bot")},
+	)...)
+	c := connect(t, server, WithJoin(ops, "Bot"), WithJoin(dev, "Bot"))
+	select {
+	case <-c.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("not ready")
+	}
+	if err := server.Err(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWithJoinTimeout(t *testing.T) {
+	const dev = "1_dev@conf.hipchat.com"
+	server := hipchattest.NewServer(append(hipchattest.Login(), hipchattest.Step{Expect: dev + "/Bot"})...)
+	c := connect(t, server, WithJoin(dev, "Bot"), WithRequestTimeout(50*time.Millisecond))
+	select {
+	case <-c.Ready():
+		t.Error("ready although the room never confirmed the join")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestRosterPushFrom(t *testing.T) {
+	push := func(from, id, jid string) string {
+		if from != "" {
+			from = " from='" + from + "'"
+		}
+		return "<iq" + from + " to='user@chat.hipchat.com/bot' type='set' id='" + id + "'>" +
+			"<query xmlns='jabber:iq:roster'><item jid='" + jid + "' name='User' subscription='both'/></query></iq>"
+	}
+	server := hipchattest.NewServer(append(hipchattest.Login(),
+		hipchattest.Step{Reply: push("1_9@chat.hipchat.com/web", "spoofed", "1_9@chat.hipchat.com")},
+		hipchattest.Step{Reply: push("", "server", "1_2@chat.hipchat.com")},
+		hipchattest.Step{Reply: push("user@chat.hipchat.com", "own", "1_3@chat.hipchat.com")},
+	)...)
+	c := connect(t, server)
+
+	for _, want := range []string{"1_2@chat.hipchat.com", "1_3@chat.hipchat.com"} {
+		select {
+		case u := <-c.RosterUpdates():
+			if u.User.Id != want {
+				t.Errorf("update for %s, want %s", u.User.Id, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no roster update")
+		}
+	}
+	waitFor(t, "the acknowledgements", func() bool { return len(server.Received()) == 5 })
+	for _, stanza := range server.Received()[3:] {
+		if strings.Contains(stanza, "spoofed") {
+			t.Errorf("acknowledged the spoofed push: %q", stanza)
+		}
+	}
+}
+
+func TestReplace(t *testing.T) {
+	const dev = "1_dev@conf.hipchat.com"
+	correction := "<message from='1_2@chat.hipchat.com/web' to='user@chat.hipchat.com/bot' type='chat' id='m2'>" +
+		"<body>fixed</body><replace id='m1' xmlns='urn:xmpp:message-correct:0'/></message>"
+	server := hipchattest.NewServer(append(hipchattest.Login(),
+		hipchattest.Step{Expect: "<replace id='m1' xmlns='urn:xmpp:message-correct:0'/>"},
+		hipchattest.Step{Expect: "<replace id='m3' xmlns='urn:xmpp:message-correct:0'/>", Reply: correction},
+	)...)
+	c := connect(t, server)
+
+	if err := c.Replace("1_2@chat.hipchat.com", "Bot", "m1", "fixed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Replace(dev, "Bot", "m3", "fixed"); err != nil {
+		t.Fatal(err)
+	}
+	if m := receive(t, c.Messages()); m.Replaces != "m1" || m.Body != "fixed" {
+		t.Errorf("received Replaces = %q, Body = %q", m.Replaces, m.Body)
+	}
+
+	// the correction is only sent once both were received
+	received := server.Received()
+	if chat := received[len(received)-2]; !strings.Contains(chat, "type='chat'") || !strings.Contains(chat, "<body>fixed</body>") {
+		t.Errorf("sent %q to a user", chat)
+	}
+	if room := received[len(received)-1]; !strings.Contains(room, "type='groupchat'") || !strings.Contains(room, "to='"+dev+"'") {
+		t.Errorf("sent %q to a room", room)
+	}
+}
+
+func TestCards(t *testing.T) {
+	const from = "1_dev@conf.hipchat.com/JIRA"
+	card := "<message from='" + from + "' to='user@chat.hipchat.com/bot' type='groupchat' id='c1'>" +
+		"<body>ISSUE-1 created</body><card style='application' format='medium'>" +
+		"<title>ISSUE-1</title><description>Fix it</description><url>https://jira.example.com/ISSUE-1</url>" +
+		"<icon url='https://jira.example.com/icon.png'/><thumbnail url='https://jira.example.com/thumb.png'/>" +
+		"<activity html='&lt;b&gt;created&lt;/b&gt;'/></card></message>"
+	link := "<message from='" + from + "' to='user@chat.hipchat.com/bot' type='groupchat' id='c2'>" +
+		"<body>https://example.com</body><card style='link'><title>Example</title>" +
+		"<description>An example</description><url>https://example.com</url>" +
+		"<thumbnail url='https://example.com/image.png'/></card></message>"
+	server := hipchattest.NewServer(append(hipchattest.Login(),
+		hipchattest.Step{Reply: card + link + chat("plain")},
+	)...)
+	c := connect(t, server)
+
+	m := receive(t, c.Messages())
+	want := Card{
+		Style:       "application",
+		Title:       "ISSUE-1",
+		Description: "Fix it",
+		URL:         "https://jira.example.com/ISSUE-1",
+		Icon:        "https://jira.example.com/icon.png",
+		Thumbnail:   "https://jira.example.com/thumb.png",
+		Activity:    "<b>created</b>",
+	}
+	if m.Card == nil || *m.Card != want || m.Body != "ISSUE-1 created" {
+		t.Errorf("card = %+v, body %q", m.Card, m.Body)
+	}
+	if m.Link != nil {
+		t.Errorf("application card has a link preview %+v", m.Link)
+	}
+
+	m = receive(t, c.Messages())
+	preview := LinkPreview{URL: "https://example.com", Title: "Example", Description: "An example", Image: "https://example.com/image.png"}
+	if m.Link == nil || *m.Link != preview {
+		t.Errorf("link preview = %+v", m.Link)
+	}
+
+	if m := receive(t, c.Messages()); m.Card != nil || m.Link != nil {
+		t.Errorf("plain message has card %+v, link %+v", m.Card, m.Link)
+	}
+}
+
+func TestFileShare(t *testing.T) {
+	share := "<message from='1_dev@conf.hipchat.com/Alice' to='user@chat.hipchat.com/bot' type='groupchat' id='f1'>" +
+		"<body>File uploaded: https://files.example.com/report.pdf</body>" +
+		"<x xmlns='http://hipchat.com/protocol/muc#room'><type>file</type><file>" +
+		"<name>report.pdf</name><size>1234</size><url>https://files.example.com/report.pdf</url>" +
+		"<thumb_url>https://files.example.com/report.png</thumb_url></file></x></message>"
+	server := hipchattest.NewServer(append(hipchattest.Login(), hipchattest.Step{Reply: share})...)
+	c := connect(t, server)
+
+	m := receive(t, c.Messages())
+	want := FileShare{Name: "report.pdf", URL: "https://files.example.com/report.pdf", Size: 1234, ThumbnailURL: "https://files.example.com/report.png"}
+	if m.File == nil || *m.File != want {
+		t.Errorf("file = %+v", m.File)
+	}
+	if m.Body != "File uploaded: https://files.example.com/report.pdf" {
+		t.Errorf("body = %q", m.Body)
+	}
+}
+
+func TestJoinSync(t *testing.T) {
+	const dev, ops, qa = "1_dev@conf.hipchat.com", "1_ops@conf.hipchat.com", "1_qa@conf.hipchat.com"
+	refused := "<presence from='" + ops + "/Bot' to='user@chat.hipchat.com/bot' type='error'>" +
+		"<error type='auth'><not-authorized xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></presence>"
+	server := hipchattest.NewServer(append(hipchattest.Login(),
+		hipchattest.Step{Expect: dev + "/Bot", Reply: selfPresence(dev, "Bot")},
+		hipchattest.Step{Expect: ops + "/Bot", Reply: refused},
+		hipchattest.Step{Expect: qa + "/Bot"},
+	)...)
+	c := connect(t, server)
+
+	if err := c.JoinSync(dev, "Bot", 5*time.Second); err != nil {
+		t.Fatalf("JoinSync(dev) = %v", err)
+	}
+	if codes, err := c.JoinCodes(dev); err != nil || len(codes) != 1 || codes[0] != StatusSelf {
+		t.Errorf("JoinCodes(dev) = %v, %v", codes, err)
+	}
+
+	err := c.JoinSync(ops, "Bot", 5*time.Second)
+	if se, ok := err.(*StanzaError); !ok || se.Condition != "not-authorized" {
+		t.Errorf("JoinSync(ops) = %v, want not-authorized", err)
+	}
+	// a refused room is forgotten, so it is not rejoined
+	if _, err := c.JoinState(ops); err != ErrNotJoined {
+		t.Errorf("JoinState(ops) error = %v, want ErrNotJoined", err)
+	}
+
+	if err := c.JoinSync(qa, "Bot", 50*time.Millisecond); err != context.DeadlineExceeded {
+		t.Errorf("JoinSync(qa) = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestChatMarkers(t *testing.T) {
+	markable := "<message from='1_2@chat.hipchat.com/web' to='user@chat.hipchat.com/bot' type='chat' id='m1'>" +
+		"<body>hi</body><markable xmlns='urn:xmpp:chat-markers:0'/></message>"
+	displayed := "<message from='1_2@chat.hipchat.com/web' to='user@chat.hipchat.com/bot' type='chat' id='m3'>" +
+		"<displayed id='m2' xmlns='urn:xmpp:chat-markers:0'/></message>"
+	server := hipchattest.NewServer(append(hipchattest.Login(),
+		hipchattest.Step{Reply: markable},
+		hipchattest.Step{Expect: "<displayed id='m1' xmlns='urn:xmpp:chat-markers:0'/>", Reply: displayed},
+	)...)
+	c := connect(t, server)
+
+	m := receive(t, c.Messages())
+	if !m.Markable {
+		t.Error("markable message not marked Markable")
+	}
+	if err := c.MarkDisplayed(m.From, m.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case marker := <-c.Markers():
+		if marker.Type != "displayed" || marker.ID != "m2" || marker.From != "1_2@chat.hipchat.com/web" {
+			t.Errorf("received marker %+v", marker)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no marker received")
+	}
+	// a marker without a body is not a message
+	select {
+	case m := <-c.Messages():
+		t.Errorf("received message %+v", m)
+	default:
+	}
+	received := server.Received()
+	if sent := received[len(received)-1]; !strings.Contains(sent, "to='1_2@chat.hipchat.com/web'") || !strings.Contains(sent, "type='chat'") {
+		t.Errorf("sent marker %q", sent)
+	}
+}
+
+func TestMessageBodyDecoded(t *testing.T) {
+	server := hipchattest.NewServer(append(hipchattest.Login(),
+		hipchattest.Step{Reply: chat("a &lt; b &amp;&amp; c &gt; d")},
+	)...)
+	c := connect(t, server)
+	if m := receive(t, c.Messages()); m.Body != "a < b && c > d" {
+		t.Errorf("Body = %q, want the entities decoded", m.Body)
+	}
+}
+
+func TestOnMessage(t *testing.T) {
+	var steps []hipchattest.Step
+	for _, body := range []string{"1", "2", "3"} {
+		steps = append(steps, hipchattest.Step{Expect: "<body>send " + body + "</body>", Reply: chat(body)})
+	}
+	server := hipchattest.NewServer(append(hipchattest.Login(), steps...)...)
+	c := connect(t, server, WithHandlerBuffer(1))
+
+	fast := make(chan string, 3)
+	c.OnMessage(func(m *Message) { fast <- m.Body })
+	started := make(chan string, 3)
+	release := make(chan struct{})
+	c.OnMessage(func(m *Message) {
+		started <- m.Body
+		<-release
+	})
+
+	// the fast handler gets every message, in order, however slow the other
+	for _, body := range []string{"1", "2", "3"} {
+		if err := c.Say("1_2@chat.hipchat.com", "Bot", "send "+body); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case got := <-fast:
+			if got != body {
+				t.Errorf("fast handler got %q, want %q", got, body)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("fast handler not called")
+		}
+		if body == "1" {
+			<-started
+		}
+	}
+
+	// the slow one is stuck on the first, has the second queued and dropped
+	// the third
+	waitFor(t, "the drop", func() bool { return c.HandlerDrops() == 1 })
+	close(release)
+	if got := <-started; got != "2" {
+		t.Errorf("slow handler got %q, want 2", got)
+	}
+}
+
+func TestEchoConfirmation(t *testing.T) {
+	const dev = "1_dev@conf.hipchat.com"
+	echo := "<message from='" + dev + "/Bot' to='user@chat.hipchat.com/bot' type='groupchat' id='{{id}}'><body>hi</body></message>"
+	server := hipchattest.NewServer(append(hipchattest.Login(),
+		hipchattest.Step{Expect: dev + "/Bot"},
+		hipchattest.Step{Expect: "<body>hi</body>", Reply: echo},
+		hipchattest.Step{Expect: "<body>lost</body>"},
+	)...)
+	c := connect(t, server, WithEchoConfirmation(100*time.Millisecond))
+	if err := c.Join(dev, "Bot"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Say(dev, "Bot", "hi"); err != nil {
+		t.Errorf("Say() = %v for an echoed message", err)
+	}
+	if m := receive(t, c.Messages()); !m.IsOwn {
+		t.Errorf("echo not marked IsOwn: %+v", m)
+	}
+	if err := c.Say(dev, "Bot", "lost"); err != ErrNoEcho {
+		t.Errorf("Say() = %v, want ErrNoEcho", err)
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	server := hipchattest.NewServer(append(hipchattest.Login(),
+		hipchattest.Step{Expect: "<body>go</body>", Reply: chat("1") + chat("2") + chat("3") + chat("4")},
+		hipchattest.Step{Expect: "<body>more</body>", Reply: chat("5")},
+	)...)
+	c := connect(t, server, WithMessageBuffer(1), WithPauseBuffer(3))
+
+	c.Pause()
+	if err := c.Say("1_2@chat.hipchat.com", "Bot", "go"); err != nil {
+		t.Fatal(err)
+	}
+	// three are held back and the fourth is dropped
+	waitFor(t, "the drop", func() bool { return c.Stats().HeldDrops == 1 })
+	select {
+	case m := <-c.Messages():
+		t.Fatalf("received %q while paused", m.Body)
+	default:
+	}
+
+	c.Resume()
+	waitFor(t, "the first held back message", func() bool { return len(c.Messages()) == 1 })
+	// received while the held back messages wait for room, so it waits too
+	if err := c.Say("1_2@chat.hipchat.com", "Bot", "more"); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"1", "2", "3", "5"} {
+		if m := receive(t, c.Messages()); m.Body != want {
+			t.Errorf("received %q, want %q", m.Body, want)
+		}
+	}
+	if drops := c.Stats().MessageDrops; drops != 0 {
+		t.Errorf("dropped %d messages after resuming", drops)
+	}
+}
+
+func TestSetDND(t *testing.T) {
+	server := hipchattest.NewServer(append(hipchattest.Login(),
+		hipchattest.Step{Expect: "<show>away</show>"},
+		hipchattest.Step{Expect: "<show>dnd</show><status>busy</status>"},
+		// the presence before the window is restored when it ends
+		hipchattest.Step{Expect: "<show>away</show>"},
+		hipchattest.Step{Expect: "<show>dnd</show><status>meeting</status>"},
+	)...)
+	// do not disturb is sent again on reconnecting within the window, once
+	// logged in
+	login := hipchattest.Login()
+	server.Then(login[0], login[1], hipchattest.Step{Expect: "<show>dnd</show><status>meeting</status>"}, login[2])
+	c := connect(t, server)
+
+	if err := c.Status("away"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetDND("busy", time.Now().Add(50*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the end of the window", func() bool { return len(server.Received()) == 6 })
+
+	if err := c.SetDND("meeting", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	server.Drop()
+	reconnected(t, c)
+	waitFor(t, "the presence after reconnecting", func() bool { return len(server.Received()) == 11 })
+	if err := server.Err(); err != nil {
+		t.Error(err)
+	}
+}
+
+// occupantPresence returns the presence a room sends when nick enters it, or
+// leaves it if typ is "unavailable".
+func occupantPresence(roomId, nick, typ string) string {
+	if typ != "" {
+		typ = " type='" + typ + "'"
+	}
+	return "<presence from='" + roomId + "/" + nick + "' to='user@chat.hipchat.com/bot'" + typ + ">" +
+		"<x xmlns='http://jabber.org/protocol/muc#user'><item affiliation='member' role='participant'/></x></presence>"
+}
+
+func TestOccupantDebounce(t *testing.T) {
+	const dev = "1_dev@conf.hipchat.com"
+	server := hipchattest.NewServer(append(hipchattest.Login(),
+		hipchattest.Step{Expect: dev + "/Bot", Reply: occupantPresence(dev, "Alice", "") + selfPresence(dev, "Bot")},
+		hipchattest.Step{Expect: "<body>go</body>", Reply: occupantPresence(dev, "Bob", "") +
+			// Alice's client reconnects, which is not reported
+			occupantPresence(dev, "Alice", "unavailable") + occupantPresence(dev, "Alice", "") +
+			occupantPresence(dev, "Bob", "unavailable")},
+	)...)
+	c := connect(t, server, WithOccupantDebounce(50*time.Millisecond))
+	if err := c.JoinSync(dev, "Bot", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := c.Say(dev, "Bot", "go"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"join Bob", "leave Bob"} {
+		select {
+		case e := <-c.OccupantEvents():
+			if got := e.Type + " " + e.Nick; got != want {
+				t.Errorf("received %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %s event", want)
+		}
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("leave reported after %v, before the debounce", d)
+	}
+	select {
+	case e := <-c.OccupantEvents():
+		t.Errorf("received %s %s", e.Type, e.Nick)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestStanzaLimits(t *testing.T) {
+	large := chat(strings.Repeat("a", 2000))
+	deep := "<message from='1_2@chat.hipchat.com/web' to='user@chat.hipchat.com/bot' type='chat'>" +
+		strings.Repeat("<x>", 10) + strings.Repeat("</x>", 10) + "</message>"
+	server := hipchattest.NewServer(append(hipchattest.Login(), hipchattest.Step{Reply: large})...).
+		Then(append(hipchattest.Login(), hipchattest.Step{Reply: deep})...).
+		Then(append(hipchattest.Login(), hipchattest.Step{Reply: chat("within")})...)
+	c := connect(t, server, WithStanzaLimits(1024, 8))
+
+	// either limit is treated as a broken connection
+	for _, want := range []error{xmpp.ErrStanzaTooLarge, xmpp.ErrStanzaTooDeep} {
+		select {
+		case info := <-c.OnReconnect():
+			if !errors.Is(info.Err, want) {
+				t.Errorf("reconnected after %v, want %v", info.Err, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("did not reconnect")
+		}
+	}
+	if m := receive(t, c.Messages()); m.Body != "within" {
+		t.Errorf("received %q", m.Body)
+	}
+}
+
+func TestMute(t *testing.T) {
+	const dev = "1_dev@conf.hipchat.com"
+	fromBob := "<message from='1_3@chat.hipchat.com/web' to='user@chat.hipchat.com/bot' type='chat' id='b1'><body>bob</body></message>"
+	server := hipchattest.NewServer(append(hipchattest.Login(),
+		hipchattest.Step{Expect: "<body>go</body>", Reply: groupchat(dev, "Alice", "room") + fromBob + chat("kept")},
+		hipchattest.Step{Expect: "<body>again</body>", Reply: groupchat(dev, "Alice", "unmuted")},
+	)...)
+	c := connect(t, server)
+
+	c.MuteRoom(dev + "/Alice")
+	c.MuteUser("1_3@chat.hipchat.com")
+	if !c.Muted(dev) || !c.Muted("1_3@chat.hipchat.com/web") || c.Muted("1_2@chat.hipchat.com") {
+		t.Error("Muted() does not match what was muted")
+	}
+	if err := c.Say("1_2@chat.hipchat.com", "Bot", "go"); err != nil {
+		t.Fatal(err)
+	}
+	if m := receive(t, c.Messages()); m.Body != "kept" {
+		t.Errorf("received %q, want only the unmuted chat", m.Body)
+	}
+
+	c.UnmuteRoom(dev)
+	if err := c.Say("1_2@chat.hipchat.com", "Bot", "again"); err != nil {
+		t.Fatal(err)
+	}
+	if m := receive(t, c.Messages()); m.Body != "unmuted" {
+		t.Errorf("received %q after unmuting the room", m.Body)
+	}
+}
+
+const conflict = "<stream:error><conflict xmlns='urn:ietf:params:xml:ns:xmpp-streams'/></stream:error></stream:stream>"
+
+func TestConflict(t *testing.T) {
+	server := hipchattest.NewServer(append(hipchattest.Login(), hipchattest.Step{Reply: conflict, Close: true})...)
+	c := connect(t, server)
+
+	// replaced by another session, the client stops
+	select {
+	case _, ok := <-c.Messages():
+		if ok {
+			t.Fatal("received a message")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Messages not closed")
+	}
+	if err := c.Err(); err != ErrConflict {
+		t.Errorf("Err() = %v, want ErrConflict", err)
+	}
+}
+
+func TestReconnectOnConflict(t *testing.T) {
+	server := hipchattest.NewServer(append(hipchattest.Login(), hipchattest.Step{Reply: conflict, Close: true})...).
+		Then(append(hipchattest.Login(), hipchattest.Step{Reply: chat("back")})...)
+	c := connect(t, server, WithReconnectOnConflict())
+
+	if m := receive(t, c.Messages()); m.Body != "back" {
+		t.Errorf("received %q", m.Body)
+	}
+	if err := c.Err(); err != nil {
+		t.Errorf("Err() = %v", err)
+	}
+}
+
+func TestConflictOnLogin(t *testing.T) {
+	login := hipchattest.Login()
+	server := hipchattest.NewServer(login[0], hipchattest.Step{
+		Expect: "jabber:iq:auth",
+		Reply:  "<iq id='{{id}}' type='error'><error type='cancel'><conflict xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>",
+	})
+	c, err := NewClient("user", "pass", "bot", WithTransport(server), WithDisableTLS(), WithLogger(nil))
+	if err != ErrConflict {
+		t.Errorf("NewClient() error = %v, want ErrConflict", err)
+	}
+	if c != nil {
+		c.Disconnect()
+	}
+}
+
+func TestAckPolicy(t *testing.T) {
+	const from = "1_2@chat.hipchat.com/web"
+	receipt := "<message from='" + from + "' to='user@chat.hipchat.com/bot' type='chat' id='r1'><body>hi</body><request xmlns='urn:xmpp:receipts'/></message>"
+	delayed := "<message from='" + from + "' to='user@chat.hipchat.com/bot' type='chat' id='m1'><body>old</body>" +
+		"<markable xmlns='urn:xmpp:chat-markers:0'/><delay xmlns='urn:xmpp:delay' stamp='2017-01-02T03:04:05Z'/></message>"
+	markable := "<message from='" + from + "' to='user@chat.hipchat.com/bot' type='chat' id='m2'><body>new</body><markable xmlns='urn:xmpp:chat-markers:0'/></message>"
+	acked := append(hipchattest.Login(),
+		hipchattest.Step{Reply: receipt},
+		hipchattest.Step{Expect: "<received id='r1' xmlns='urn:xmpp:receipts'/>", Reply: delayed + markable},
+		// the replayed message is not acknowledged
+		hipchattest.Step{Expect: "<received id='m2' xmlns='urn:xmpp:chat-markers:0'/>"},
+	)
+	unacked := append(hipchattest.Login(),
+		hipchattest.Step{Reply: receipt + delayed + markable},
+		hipchattest.Step{Expect: "<body>next</body>"},
+	)
+
+	for _, tt := range []struct {
+		name   string
+		script []hipchattest.Step
+		opts   []Option
+		sent   int // stanzas the client sends after logging in
+	}{
+		{"receipts and markers", acked, []Option{WithAckPolicy(AckPolicy{Receipts: true, Markers: true})}, 2},
+		{"default", unacked, nil, 1},
+	} {
+		server := hipchattest.NewServer(tt.script...)
+		c := connect(t, server, tt.opts...)
+		for i := 0; i < 3; i++ {
+			receive(t, c.Messages())
+		}
+		if tt.opts == nil {
+			// nothing was sent before this
+			if err := c.Say("1_2@chat.hipchat.com", "Bot", "next"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		waitFor(t, tt.name+" acknowledgements", func() bool { return len(server.Received()) == 3+tt.sent })
+		if err := server.Err(); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		c.Disconnect()
+	}
+}
+
+func TestAuthzid(t *testing.T) {
+	const plain = "<mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><mechanism>PLAIN</mechanism></mechanisms>"
+	response := base64.StdEncoding.EncodeToString([]byte("svc@chat.hipchat.com\x00user\x00pass"))
+	boundAs := func(jid string) string {
+		return "<iq id='{{id}}' type='result'><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'><jid>" + jid + "</jid></bind></iq>"
+	}
+	login := func(steps ...hipchattest.Step) []hipchattest.Step {
+		return append([]hipchattest.Step{{Expect: "<stream:stream", Reply: stream + features(plain)}}, steps...)
+	}
+	refused := "<failure xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><invalid-authzid/><text>not allowed</text></failure>"
+
+	tests := []struct {
+		name   string
+		script []hipchattest.Step
+		err    error
+	}{
+		{"accepted", login(
+			hipchattest.Step{Expect: response, Reply: success},
+			hipchattest.Step{Expect: "<stream:stream", Reply: stream + features(bind)},
+			hipchattest.Step{Expect: "<resource>bot</resource>", Reply: boundAs("svc@chat.hipchat.com/bot")},
+		), nil},
+		{"refused", login(hipchattest.Step{Expect: response, Reply: refused}), ErrAuthzidRefused},
+		{"bound as someone else", login(
+			hipchattest.Step{Expect: response, Reply: success},
+			hipchattest.Step{Expect: "<stream:stream", Reply: stream + features(bind)},
+			hipchattest.Step{Expect: "<resource>bot</resource>", Reply: boundAs("user@chat.hipchat.com/bot")},
+		), ErrAuthzidRefused},
+	}
+	for _, tt := range tests {
+		server := hipchattest.NewServer(tt.script...)
+		c, err := NewClient("user", "pass", "bot", WithTransport(server), WithDisableTLS(),
+			WithLogger(nil), WithAuthzid("svc@chat.hipchat.com"))
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: NewClient() error = %v, want %v", tt.name, err, tt.err)
+		}
+		if err == nil && c.JID() != "svc@chat.hipchat.com" {
+			t.Errorf("%s: JID() = %q, want the authorization identity", tt.name, c.JID())
+		}
+		if err := server.Err(); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if c != nil {
+			c.Disconnect()
+		}
+	}
+}
+
+func TestServerCapabilities(t *testing.T) {
+	caps := "<presence from='chat.hipchat.com'><c xmlns='http://jabber.org/protocol/caps' hash='sha-1' node='http://hipchat.com' ver='v1'/></presence>"
+	server := hipchattest.NewServer(append(hipchattest.Login(),
+		hipchattest.Step{Expect: "<body>go</body>", Reply: caps},
+		hipchattest.Step{Expect: "node='http://hipchat.com#v1'", Reply: "<iq from='chat.hipchat.com' id='{{id}}' type='result'>" +
+			"<query xmlns='http://jabber.org/protocol/disco#info' node='http://hipchat.com#v1'>" +
+			"<feature var='urn:xmpp:ping'/><feature var='urn:xmpp:carbons:2'/></query></iq>"},
+		// the same caps again are resolved from the cache
+		hipchattest.Step{Expect: "<body>again</body>", Reply: caps},
+		hipchattest.Step{Expect: "<body>done</body>"},
+	)...)
+	c := connect(t, server)
+	if features := c.ServerCapabilities(); features != nil {
+		t.Errorf("ServerCapabilities() = %q before the server advertised any", features)
+	}
+	if err := c.Say("1_2@chat.hipchat.com", "Bot", "go"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the capabilities", func() bool { return c.ServerCapabilities() != nil })
+	want := []string{"urn:xmpp:ping", "urn:xmpp:carbons:2"}
+	if features := c.ServerCapabilities(); !reflect.DeepEqual(features, want) {
+		t.Errorf("ServerCapabilities() = %q, want %q", features, want)
+	}
+
+	c.Say("1_2@chat.hipchat.com", "Bot", "again")
+	time.Sleep(50 * time.Millisecond) // for the presence to arrive
+	c.Say("1_2@chat.hipchat.com", "Bot", "done")
+	waitFor(t, "the last message", func() bool { return len(server.Received()) == 7 })
+	if err := server.Err(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOutgoingFilter(t *testing.T) {
+	server := hipchattest.NewServer(append(hipchattest.Login(),
+		hipchattest.Step{Expect: "<body>password=[redacted]</body>"},
+		hipchattest.Step{Expect: "<body>token=[redacted]</body>"},
+		hipchattest.Step{Expect: "<body>password=hunter2</body>"},
+	)...)
+	c := connect(t, server)
+
+	secret := regexp.MustCompile(`=\S+`)
+	c.SetOutgoingFilter(func(body string) string { return secret.ReplaceAllString(body, "=[redacted]") })
+	if err := c.Say("1_2@chat.hipchat.com", "Bot", "password=hunter2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Replace("1_2@chat.hipchat.com", "Bot", "m1", "token=abc"); err != nil {
+		t.Fatal(err)
+	}
+	c.SetOutgoingFilter(nil)
+	if err := c.Say("1_2@chat.hipchat.com", "Bot", "password=hunter2"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the messages", func() bool { return len(server.Received()) == 6 })
+	if err := server.Err(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,270 @@
+// Package hipchattest provides an in-memory XMPP server that plays a script,
+// for testing code built on the hipchat package without a network.
+//
+// The server only speaks TLS when its script says so, so clients must be
+// created with hipchat.WithDisableTLS as well as hipchat.WithTransport:
+//
+//	server := hipchattest.NewServer(hipchattest.Login()...)
+//	client, err := hipchat.NewClient("user", "pass", "bot",
+//		hipchat.WithTransport(server), hipchat.WithDisableTLS())
+//
+// or, to test StartTLS, play TLSLogin and have the client trust the server's
+// certificate:
+//
+//	cert, roots := hipchattest.NewCertificate("chat.hipchat.com")
+//	server := hipchattest.NewServer(hipchattest.TLSLogin(cert)...)
+//	client, err := hipchat.NewClient("user", "pass", "bot",
+//		hipchat.WithTransport(server), hipchat.WithRootCAs(roots))
+package hipchattest
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// A Step is one exchange of a script. The server waits for the client's next
+// stanza, which must contain Expect, and then sends Reply. Either may be
+// empty: a Step without Expect replies straight away, one without Reply only
+// checks what the client sent. Replies are buffered, as a socket's writes are,
+// so the server goes on without waiting for the client to read them. "{{id}}"
+// in Reply is replaced with the id of the stanza the client sent, so replies
+// can answer requests. Close drops the connection after the reply, ending the
+// script. TLS, if set, upgrades the connection to TLS with it after the reply,
+// as a server does after agreeing to StartTLS, and the rest of the script is
+// played over TLS. Stall stops reading after the reply, as the far end of a
+// stalled network does, so the client's writes block until Drop is called.
+type Step struct {
+	Expect string
+	Reply  string
+	Close  bool
+	TLS    *tls.Config
+	Stall  bool
+}
+
+// A Server is a hipchat.Transport that plays a script to each connection the
+// client opens. Once the script is finished, the server reads and records
+// whatever the client sends until the connection is closed.
+type Server struct {
+	mu       sync.Mutex
+	scripts  [][]Step
+	conns    int
+	conn     net.Conn      // server side of the last connection
+	dropped  chan struct{} // closed by Drop, for the last connection
+	err      error
+	received []string
+}
+
+var idAttr = regexp.MustCompile(`id='([^']*)'`)
+
+// NewServer returns a Server that plays script to the first connection.
+func NewServer(script ...Step) *Server {
+	return &Server{scripts: [][]Step{script}}
+}
+
+// Then adds the script played to the next connection, for testing reconnects.
+// Connections after the last script get an empty one.
+func (s *Server) Then(script ...Step) *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scripts = append(s.scripts, script)
+	return s
+}
+
+// Dial opens a new in-memory connection to the server.
+func (s *Server) Dial(addr string) (net.Conn, error) {
+	s.mu.Lock()
+	var script []Step
+	if s.conns < len(s.scripts) {
+		script = s.scripts[s.conns]
+	}
+	client, server := net.Pipe()
+	dropped := make(chan struct{})
+	s.conns++
+	s.conn, s.dropped = server, dropped
+	s.mu.Unlock()
+
+	go s.play(newBufferedConn(server), script, dropped)
+	return client, nil
+}
+
+// Drop closes the last connection the client opened, as if the network had
+// failed, so that the client reconnects and is played the next script.
+func (s *Server) Drop() {
+	s.mu.Lock()
+	conn, dropped := s.conn, s.dropped
+	s.conn, s.dropped = nil, nil
+	s.mu.Unlock()
+	if conn != nil {
+		close(dropped)
+		conn.Close()
+	}
+}
+
+// Err returns the first difference between the script and what the client
+// sent, or nil if there was none.
+func (s *Server) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Received returns the stanzas the client has sent on all connections.
+func (s *Server) Received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.received...)
+}
+
+func (s *Server) play(conn net.Conn, script []Step, dropped <-chan struct{}) {
+	defer func() { conn.Close() }()
+	for _, step := range script {
+		var stanza string
+		if step.Expect != "" {
+			var err error
+			if stanza, err = s.read(conn); err != nil {
+				s.fail(fmt.Errorf("expected %q, connection closed: %v", step.Expect, err))
+				return
+			}
+			if !strings.Contains(stanza, step.Expect) {
+				s.fail(fmt.Errorf("expected %q, received %q", step.Expect, stanza))
+				return
+			}
+		}
+		if step.Reply != "" {
+			reply := step.Reply
+			if m := idAttr.FindStringSubmatch(stanza); m != nil {
+				reply = strings.Replace(reply, "{{id}}", m[1], -1)
+			}
+			if _, err := conn.Write([]byte(reply)); err != nil {
+				return
+			}
+		}
+		if step.Close {
+			return
+		}
+		if step.Stall {
+			<-dropped
+			return
+		}
+		if step.TLS != nil {
+			secure := tls.Server(conn, step.TLS)
+			if err := secure.Handshake(); err != nil {
+				s.fail(fmt.Errorf("TLS handshake failed: %v", err))
+				return
+			}
+			conn = secure
+		}
+	}
+
+	for {
+		if _, err := s.read(conn); err != nil {
+			return
+		}
+	}
+}
+
+// read reads the next stanza from the client, which writes each stanza in a
+// single write.
+func (s *Server) read(conn net.Conn) (string, error) {
+	b := make([]byte, 64*1024)
+	n, err := conn.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	stanza := string(b[:n])
+	s.mu.Lock()
+	s.received = append(s.received, stanza)
+	s.mu.Unlock()
+	return stanza, nil
+}
+
+func (s *Server) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// A bufferedConn is the server's side of a connection. Its writes are queued
+// and sent in order by another goroutine, as a socket's send buffer would, so
+// that the server can reply while the client is writing to it too.
+type bufferedConn struct {
+	net.Conn
+	mu      sync.Mutex
+	queue   [][]byte
+	queued  chan struct{} // signalled when the queue grows
+	closing bool
+	err     error
+	flushed chan struct{} // closed once the queue is sent or cannot be
+}
+
+func newBufferedConn(conn net.Conn) *bufferedConn {
+	b := &bufferedConn{Conn: conn, queued: make(chan struct{}, 1), flushed: make(chan struct{})}
+	go b.flush()
+	return b
+}
+
+func (b *bufferedConn) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return 0, b.err
+	}
+	if b.closing {
+		return 0, io.ErrClosedPipe
+	}
+	b.queue = append(b.queue, append([]byte(nil), p...))
+	select {
+	case b.queued <- struct{}{}:
+	default:
+	}
+	return len(p), nil
+}
+
+// Close closes the connection once what was written has been sent, or the
+// client has stopped reading by closing its side.
+func (b *bufferedConn) Close() error {
+	b.mu.Lock()
+	b.closing = true
+	b.mu.Unlock()
+	select {
+	case b.queued <- struct{}{}:
+	default:
+	}
+	<-b.flushed
+	return b.Conn.Close()
+}
+
+// flush sends the queued writes until the connection is closed.
+func (b *bufferedConn) flush() {
+	defer close(b.flushed)
+	for {
+		b.mu.Lock()
+		if len(b.queue) == 0 {
+			closing := b.closing
+			b.mu.Unlock()
+			if closing {
+				return
+			}
+			<-b.queued
+			continue
+		}
+		p := b.queue[0]
+		b.queue = b.queue[1:]
+		b.mu.Unlock()
+
+		if _, err := b.Conn.Write(p); err != nil {
+			b.mu.Lock()
+			b.err, b.queue = err, nil
+			b.mu.Unlock()
+			return
+		}
+	}
+}
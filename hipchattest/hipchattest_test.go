@@ -0,0 +1,178 @@
+package hipchattest_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mackross/go-hipchat"
+	"github.com/mackross/go-hipchat/hipchattest"
+)
+
+func TestServer(t *testing.T) {
+	cert, roots := hipchattest.NewCertificate("chat.hipchat.com")
+
+	tests := []struct {
+		name   string
+		script []hipchattest.Step
+		opts   []hipchat.Option
+		err    string // expected from NewClient
+		check  func(*testing.T, *hipchat.Client)
+	}{
+		{
+			name:   "login",
+			script: hipchattest.Login(),
+			opts:   []hipchat.Option{hipchat.WithDisableTLS()},
+			check: func(t *testing.T, c *hipchat.Client) {
+				if c.IsSecure() {
+					t.Error("IsSecure() = true without TLS")
+				}
+			},
+		},
+		{
+			name:   "failed login",
+			script: hipchattest.FailedLogin(),
+			opts:   []hipchat.Option{hipchat.WithDisableTLS()},
+			err:    "could not authenticate",
+		},
+		{
+			name:   "starttls",
+			script: hipchattest.TLSLogin(cert),
+			opts:   []hipchat.Option{hipchat.WithRootCAs(roots)},
+			check: func(t *testing.T, c *hipchat.Client) {
+				if !c.IsSecure() {
+					t.Error("IsSecure() = false after StartTLS")
+				}
+				if h := c.Handshake().String(); !strings.Contains(h, "starttls") || !strings.Contains(h, "tls (TLS 1.3") {
+					t.Errorf("Handshake() = %s", h)
+				}
+			},
+		},
+		{
+			name:   "starttls untrusted",
+			script: hipchattest.TLSLogin(cert),
+			err:    "TLS handshake failed",
+		},
+		{
+			name:   "starttls not offered",
+			script: hipchattest.Login(),
+			err:    "server did not offer StartTLS",
+		},
+		{
+			name: "disco",
+			script: append(hipchattest.Login(), hipchattest.Step{
+				Expect: "disco#info",
+				Reply:  "<iq id='{{id}}' type='result' from='chat.hipchat.com'><query xmlns='http://jabber.org/protocol/disco#info'><identity category='server' type='im' name='HipChat'/><feature var='urn:xmpp:ping'/></query></iq>",
+			}),
+			opts: []hipchat.Option{hipchat.WithDisableTLS()},
+			check: func(t *testing.T, c *hipchat.Client) {
+				info, err := c.DiscoInfo("chat.hipchat.com")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !info.HasFeature("urn:xmpp:ping") || len(info.Identities) != 1 || info.Identities[0].Name != "HipChat" {
+					t.Errorf("DiscoInfo() = %+v", info)
+				}
+			},
+		},
+		{
+			name: "rooms",
+			script: append(hipchattest.Login(), hipchattest.Step{
+				Expect: "disco#items",
+				Reply:  "<iq id='{{id}}' type='result' from='conf.hipchat.com'><query xmlns='http://jabber.org/protocol/disco#items'><item jid='1_dev@conf.hipchat.com' name='Dev'/></query></iq>",
+			}),
+			opts: []hipchat.Option{hipchat.WithDisableTLS()},
+			check: func(t *testing.T, c *hipchat.Client) {
+				rooms, err := c.Rooms()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(rooms) != 1 || rooms[0].Id != "1_dev@conf.hipchat.com" || rooms[0].Name != "Dev" {
+					t.Errorf("Rooms() = %+v", rooms)
+				}
+			},
+		},
+		{
+			name: "roster",
+			script: append(hipchattest.Login(), hipchattest.Step{
+				Expect: "jabber:iq:roster",
+				Reply:  "<iq id='{{id}}' type='result'><query xmlns='jabber:iq:roster'><item jid='1_2@chat.hipchat.com' name='Alice' mention_name='alice' subscription='both'><group>Dev</group></item></query></iq>",
+			}),
+			opts: []hipchat.Option{hipchat.WithDisableTLS()},
+			check: func(t *testing.T, c *hipchat.Client) {
+				users, err := c.Users()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(users) != 1 || users[0].Id != "1_2@chat.hipchat.com" || users[0].MentionName != "alice" || len(users[0].Groups) != 1 {
+					t.Errorf("Users() = %+v", users)
+				}
+			},
+		},
+		{
+			name:   "message",
+			script: append(hipchattest.Login(), hipchattest.Message("chat", "1_2@chat.hipchat.com/web", "user@chat.hipchat.com/bot", "hi <there>")),
+			opts:   []hipchat.Option{hipchat.WithDisableTLS()},
+			check: func(t *testing.T, c *hipchat.Client) {
+				m := receive(t, c.Messages())
+				if m.From != "1_2@chat.hipchat.com/web" || m.Type != "chat" || m.Body != "hi <there>" {
+					t.Errorf("received %+v", m)
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := hipchattest.NewServer(test.script...)
+			opts := append([]hipchat.Option{hipchat.WithTransport(server)}, test.opts...)
+			c, err := hipchat.NewClient("user", "pass", "bot", opts...)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("NewClient() error = %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Disconnect()
+
+			if test.check != nil {
+				test.check(t, c)
+			}
+			if err := server.Err(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestServerDrop(t *testing.T) {
+	server := hipchattest.NewServer(hipchattest.Login()...).
+		Then(append(hipchattest.Login(), hipchattest.Message("chat", "1_2@chat.hipchat.com/web", "user@chat.hipchat.com/bot", "again"))...)
+	c, err := hipchat.NewClient("user", "pass", "bot", hipchat.WithTransport(server), hipchat.WithDisableTLS())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Disconnect()
+
+	server.Drop()
+	if m := receive(t, c.Messages()); m.Body != "again" {
+		t.Errorf("received %q after reconnecting", m.Body)
+	}
+	if err := server.Err(); err != nil {
+		t.Error(err)
+	}
+}
+
+func receive(t *testing.T, messages <-chan *hipchat.Message) *hipchat.Message {
+	t.Helper()
+	select {
+	case m := <-messages:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+		return nil
+	}
+}
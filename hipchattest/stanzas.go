@@ -0,0 +1,63 @@
+package hipchattest
+
+import (
+	"crypto/tls"
+	"fmt"
+	"html"
+)
+
+const (
+	xmlStream      = "<?xml version='1.0'?><stream:stream from='chat.hipchat.com' id='stream' version='1.0' xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams'>"
+	xmlFeatures    = "<stream:features><mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><mechanism>PLAIN</mechanism></mechanisms></stream:features>"
+	xmlTLSFeatures = "<stream:features><starttls xmlns='urn:ietf:params:xml:ns:xmpp-tls'><required/></starttls><mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><mechanism>PLAIN</mechanism></mechanisms></stream:features>"
+)
+
+// Login returns the steps of a successful legacy login, up to and including
+// the roster the client fetches once connected.
+func Login() []Step {
+	return []Step{
+		{Expect: "<stream:stream", Reply: xmlStream + xmlFeatures},
+		{Expect: "jabber:iq:auth", Reply: "<iq id='{{id}}' type='result'/>"},
+		{Expect: "jabber:iq:roster", Reply: "<iq id='{{id}}' type='result'><query xmlns='jabber:iq:roster'/></iq>"},
+	}
+}
+
+// TLSLogin returns the steps of a successful login that starts with StartTLS,
+// as clients created without hipchat.WithDisableTLS insist on. cert is the
+// server's certificate, see NewCertificate.
+func TLSLogin(cert tls.Certificate) []Step {
+	return append([]Step{
+		{Expect: "<stream:stream", Reply: xmlStream + xmlTLSFeatures},
+		StartTLS(cert),
+	}, Login()...)
+}
+
+// StartTLS returns a step that agrees to the client's request to start TLS
+// and then upgrades the connection with cert as the server's certificate.
+func StartTLS(cert tls.Certificate) Step {
+	return Step{
+		Expect: "<starttls",
+		Reply:  "<proceed xmlns='urn:ietf:params:xml:ns:xmpp-tls'/>",
+		TLS:    &tls.Config{Certificates: []tls.Certificate{cert}},
+	}
+}
+
+// FailedLogin returns the steps of a login the server refuses.
+func FailedLogin() []Step {
+	return []Step{
+		{Expect: "<stream:stream", Reply: xmlStream + xmlFeatures},
+		{Expect: "jabber:iq:auth", Reply: "<iq id='{{id}}' type='error'><error type='auth'><not-authorized xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>"},
+	}
+}
+
+// KeepAlive returns a step that sends the client the whitespace HipChat sends
+// between stanzas to keep an idle connection open.
+func KeepAlive() Step {
+	return Step{Reply: " \n "}
+}
+
+// Message returns a step that sends the client a message.
+func Message(typ, from, to, body string) Step {
+	return Step{Reply: fmt.Sprintf("<message from='%s' to='%s' type='%s' id='hipchattest'><body>%s</body></message>",
+		html.EscapeString(from), html.EscapeString(to), html.EscapeString(typ), html.EscapeString(body))}
+}
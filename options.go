@@ -0,0 +1,459 @@
+package hipchat
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+	"unicode/utf8"
+)
+
+// An Option configures a Client. Options are passed to NewClient and applied
+// before the Client connects. The options setting buffer sizes raise sizes
+// below 1 to 1, as every buffer must hold at least the latest item for
+// delivery not to drop everything.
+type Option func(*Client)
+
+// atLeastOne returns n, or 1 if n is less.
+func atLeastOne(n int) int {
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+type config struct {
+	connectAddr   string
+	transport     Transport
+	tcpKeepAlive  time.Duration
+	ids           IDGenerator
+	tlsServerName string
+	xmppDomain    string
+	confDomain    string
+	disableTLS    bool
+	minTLSVersion uint16
+	certificates  []tls.Certificate
+	rootCAs       *x509.CertPool
+	anonymous     bool
+	authzid       string
+	carbons       bool
+	acks          AckPolicy
+	retryConflict bool
+	maxStanzaSize int64
+	maxDepth      int
+	software      string
+	version       string
+	noAutoReplies bool
+
+	rooms           []RoomJoin
+	presence        *status
+	presenceRefresh time.Duration
+	replayMissed    int
+	store           Store
+	requestTimeout  time.Duration
+	logger          *log.Logger
+	maxLength       int
+	sendInterval    time.Duration
+	echoTimeout     time.Duration
+	emoticons       func(Emoticon) string
+	debounce        time.Duration
+
+	messageBuffer   int
+	handlerBuffer   int
+	pauseBuffer     int
+	roomHistory     int
+	rosterBuffer    int
+	mentionBuffer   int
+	systemBuffer    int
+	errorBuffer     int
+	markerBuffer    int
+	roomStateBuffer int
+	occupantBuffer  int
+	subscribeBuffer int
+	connectBuffer   int
+	reconnectBuffer int
+}
+
+func defaultConfig() config {
+	return config{
+		xmppDomain:     defaultDomain,
+		software:       "go-hipchat",
+		version:        "devel",
+		minTLSVersion:  tls.VersionTLS12,
+		maxStanzaSize:  16 << 20,
+		maxDepth:       64,
+		requestTimeout: 30 * time.Second,
+		logger:         log.New(os.Stderr, "hipchat: ", log.LstdFlags),
+		maxLength:      10000,
+		debounce:       3 * time.Second,
+
+		messageBuffer:   100,
+		handlerBuffer:   100,
+		pauseBuffer:     1000,
+		rosterBuffer:    64,
+		mentionBuffer:   64,
+		systemBuffer:    64,
+		errorBuffer:     64,
+		markerBuffer:    64,
+		roomStateBuffer: 64,
+		occupantBuffer:  64,
+		subscribeBuffer: 64,
+		connectBuffer:   1,
+		reconnectBuffer: 8,
+	}
+}
+
+// WithConnectAddr sets the address dialed to reach the XMPP server, as host or
+// host:port. The port defaults to 5222. The default is the XMPP domain.
+func WithConnectAddr(addr string) Option {
+	return func(c *Client) { c.config.connectAddr = addr }
+}
+
+// WithLogger sets where the client logs warnings, such as dropped messages,
+// and failures it cannot return, such as reconnecting. A nil logger discards
+// them. The default logs to standard error with the prefix "hipchat: ".
+func WithLogger(l *log.Logger) Option {
+	if l == nil {
+		l = log.New(ioutil.Discard, "", 0)
+	}
+	return func(c *Client) { c.config.logger = l }
+}
+
+// WithTransport makes the client open its connections with t instead of
+// dialing TCP, for example to talk to an in-memory server in tests.
+func WithTransport(t Transport) Option {
+	return func(c *Client) { c.config.transport = t }
+}
+
+// WithTCPKeepAlive sets how often the operating system probes an idle
+// connection to notice a dead peer or keep a NAT mapping alive, or turns the
+// probes off if period is negative. It works below KeepAlive, which sends
+// whitespace over XMPP and so only notices a dead peer when a write fails;
+// short probes catch that sooner. The default is Go's, every 15 seconds.
+func WithTCPKeepAlive(period time.Duration) Option {
+	return func(c *Client) { c.config.tcpKeepAlive = period }
+}
+
+// WithIDGenerator makes the client take the ids of the stanzas it sends, and
+// of received messages that have none, from g instead of generating random
+// ones, so tests can predict them.
+func WithIDGenerator(g IDGenerator) Option {
+	return func(c *Client) { c.config.ids = g }
+}
+
+// WithTLSServerName sets the server name sent via SNI and verified against the
+// server's certificate after StartTLS. The default is the XMPP domain.
+func WithTLSServerName(name string) Option {
+	return func(c *Client) { c.config.tlsServerName = name }
+}
+
+// WithXMPPDomain sets the domain of the client's JID and the stream. The
+// default is chat.hipchat.com.
+func WithXMPPDomain(domain string) Option {
+	return func(c *Client) { c.config.xmppDomain = domain }
+}
+
+// WithConferenceDomain sets the domain of the client's rooms. The default is
+// conf.hipchat.com for HipChat and "conf." followed by the XMPP domain for
+// other servers.
+func WithConferenceDomain(domain string) Option {
+	return func(c *Client) { c.config.confDomain = domain }
+}
+
+// WithDisableTLS skips the StartTLS upgrade and authenticates over a cleartext
+// connection. It exists only for testing against local plaintext servers and
+// must never be used against HipChat, as the password is sent unencrypted.
+func WithDisableTLS() Option {
+	return func(c *Client) { c.config.disableTLS = true }
+}
+
+// WithMinTLSVersion sets the oldest TLS version, such as tls.VersionTLS13,
+// the client accepts. Connecting fails if the server cannot negotiate it. The
+// default is TLS 1.2.
+func WithMinTLSVersion(version uint16) Option {
+	return func(c *Client) { c.config.minTLSVersion = version }
+}
+
+// WithClientCertificate presents cert during the StartTLS handshake for
+// servers that authenticate clients with mutual TLS. When the server offers
+// the SASL EXTERNAL mechanism, the client authenticates with the certificate
+// instead of the password.
+func WithClientCertificate(cert tls.Certificate) Option {
+	return func(c *Client) { c.config.certificates = append(c.config.certificates, cert) }
+}
+
+// WithRootCAs sets the certificate authorities the client trusts to verify
+// the server's certificate during StartTLS, for HipChat Server deployments
+// with a certificate from a private authority. The default is the system's.
+func WithRootCAs(roots *x509.CertPool) Option {
+	return func(c *Client) { c.config.rootCAs = roots }
+}
+
+// WithStanzaLimits bounds the stanzas the client accepts to about maxSize
+// bytes and maxDepth levels of nested elements, counting the stream itself as
+// the first. A server that exceeds them is treated like a broken connection
+// and the client reconnects, rather than allocating without limit. Zero
+// removes a limit. The defaults, 16 MiB and 64 levels, leave room for the
+// roster of a large organization, which arrives as a single stanza.
+func WithStanzaLimits(maxSize int64, maxDepth int) Option {
+	return func(c *Client) { c.config.maxStanzaSize, c.config.maxDepth = maxSize, maxDepth }
+}
+
+// WithReconnectOnConflict makes the client reconnect when HipChat disconnects
+// it because another session logged in with the same resource, taking the
+// resource back. By default the client stops instead, closing its channels
+// with Err returning ErrConflict, so that two instances of a bot sharing a
+// resource do not keep replacing each other. XMPP leaves it to the server
+// whether a new session replaces the old one or is refused; when it is
+// refused, connecting fails with ErrConflict.
+func WithReconnectOnConflict() Option {
+	return func(c *Client) { c.config.retryConflict = true }
+}
+
+// WithAnonymous logs in with SASL ANONYMOUS instead of a user name and
+// password, for read-only tools that only watch public rooms. The user name
+// and password given to NewClient are ignored and the server assigns the JID,
+// which JID returns. The roster is not fetched. Most HipChat Cloud servers do
+// not allow anonymous logins, but HipChat Server deployments may be configured
+// to.
+func WithAnonymous() Option {
+	return func(c *Client) { c.config.anonymous = true }
+}
+
+// WithAuthzid authenticates as the account the client was created for but
+// asks to act as authzid, the JID of another identity, as service accounts of
+// some HipChat Server deployments are allowed to. The client then sends and
+// receives as authzid. It requires SASL PLAIN, which the server must offer,
+// and NewClient returns ErrAuthzidRefused if the server does not let the
+// account act as authzid.
+func WithAuthzid(authzid string) Option {
+	return func(c *Client) { c.config.authzid = authzid }
+}
+
+// WithCarbons enables message carbons (XEP-0280), so that chats sent and
+// received by the account's other sessions, such as a person using the web
+// client, are delivered on Messages too, with Carbon set.
+func WithCarbons() Option {
+	return func(c *Client) { c.config.carbons = true }
+}
+
+// WithSoftwareVersion sets the name and version the client answers software
+// version queries (XEP-0092) with. The default is "go-hipchat" version
+// "devel".
+func WithSoftwareVersion(name, version string) Option {
+	return func(c *Client) { c.config.software, c.config.version = name, version }
+}
+
+// WithDisableAutoReplies stops the client answering software version
+// (XEP-0092) and entity time (XEP-0202) queries from other clients, which it
+// does by default. Pings are always answered.
+func WithDisableAutoReplies() Option {
+	return func(c *Client) { c.config.noAutoReplies = true }
+}
+
+// WithAckPolicy makes the client acknowledge the messages it receives by
+// itself, as p says, rather than leaving it to MarkReceived. By default
+// nothing is acknowledged.
+func WithAckPolicy(p AckPolicy) Option {
+	return func(c *Client) { c.config.acks = p }
+}
+
+// WithPresenceOnConnect sends the given availability, as for Status, and
+// status text as soon as the client has logged in, so it is never online
+// without them. The presence last set with Status or SetCustomStatus replaces
+// it and is sent again whenever the client reconnects.
+func WithPresenceOnConnect(show, statusText string) Option {
+	return func(c *Client) { c.config.presence = &status{show: show, text: statusText} }
+}
+
+// WithJoin joins a room as soon as the client connects. The rooms are joined
+// one at a time, in the order given, and Ready is not closed until every such
+// room has confirmed the join. Giving a room again changes its resource.
+func WithJoin(roomId, resource string) Option {
+	return func(c *Client) {
+		for i, r := range c.config.rooms {
+			if r.RoomId == roomId {
+				c.config.rooms[i].Nick = resource
+				return
+			}
+		}
+		c.config.rooms = append(c.config.rooms, RoomJoin{RoomId: roomId, Nick: resource})
+	}
+}
+
+// WithPresenceRefresh re-sends the client's presence to every joined room at
+// the given interval, so rooms that drop idle occupants keep listing the
+// client. This is separate from KeepAlive, which only keeps the connection
+// open. Refreshing stops when the client is disconnected. It is disabled by
+// default.
+func WithPresenceRefresh(interval time.Duration) Option {
+	return func(c *Client) { c.config.presenceRefresh = interval }
+}
+
+// WithReplayMissed requests the messages sent to each joined room while the
+// client was reconnecting, up to maxStanzas per room, when it rejoins. They are
+// delivered on Messages marked as Delayed. Without this option no history is
+// requested on rejoin.
+func WithReplayMissed(maxStanzas int) Option {
+	return func(c *Client) { c.config.replayMissed = maxStanzas }
+}
+
+// WithStore keeps the time of the last message seen in each room in s, so that
+// when a room is first joined with Join after the process restarts, the client
+// asks it for the messages sent since, up to the number set with
+// WithReplayMissed if any. They are delivered on Messages marked as Delayed.
+// Rooms only send history at the granularity of a second, so a message seen
+// just before the restart may be delivered again. Rooms joined with JoinAll
+// get the history it asks for instead. Times are saved in the background, at
+// most once a second, and once more by Close or Disconnect, so a process that
+// exits without calling either may lose the last second. By default nothing is
+// kept.
+func WithStore(s Store) Option {
+	return func(c *Client) { c.config.store = s }
+}
+
+// WithRequestTimeout sets how long Rooms and Users wait for HipChat to reply.
+// The Context variants are bounded by their context instead. The default is 30
+// seconds.
+func WithRequestTimeout(d time.Duration) Option {
+	return func(c *Client) { c.config.requestTimeout = d }
+}
+
+// WithMaxMessageLength sets the length, in bytes, of the longest message
+// SayLong sends before splitting the body. Lengths below utf8.UTFMax are raised
+// to it, so that every character fits. The default is 10000, HipChat's limit.
+func WithMaxMessageLength(n int) Option {
+	if n < utf8.UTFMax {
+		n = utf8.UTFMax
+	}
+	return func(c *Client) { c.config.maxLength = n }
+}
+
+// WithSendInterval sets the least time between the messages SayLong sends for
+// one body, and between the joins JoinAll sends, so that sending in bulk stays
+// under HipChat's rate limit, which disconnects clients that send too much.
+// The client does not limit other sends. The default is 0, no pause.
+func WithSendInterval(d time.Duration) Option {
+	return func(c *Client) { c.config.sendInterval = d }
+}
+
+// WithEchoConfirmation makes Say and SayWithID wait, for messages to a room,
+// until the room echoes the message back, confirming it was accepted. They
+// return ErrNoEcho if the echo does not arrive within timeout. By default they
+// return as soon as the message is written.
+func WithEchoConfirmation(timeout time.Duration) Option {
+	return func(c *Client) { c.config.echoTimeout = timeout }
+}
+
+// WithEmoticonReplacer sets a function that replaces the emoticon shortcuts,
+// such as "(thumbsup)", in the bodies of received messages with whatever it
+// returns, for example UnicodeEmoticon or StripEmoticon. By default bodies are
+// left as HipChat sent them.
+func WithEmoticonReplacer(replace func(Emoticon) string) Option {
+	return func(c *Client) { c.config.emoticons = replace }
+}
+
+// WithOccupantDebounce sets how long someone who leaves a room has to come
+// back before OccupantEvents reports that they left. Someone who rejoins in
+// time, for example because their client reconnected, is reported neither
+// leaving nor joining. Zero reports every change straight away. The default is
+// 3 seconds.
+func WithOccupantDebounce(d time.Duration) Option {
+	return func(c *Client) { c.config.debounce = d }
+}
+
+// WithMessageBuffer sets the number of messages buffered on the Messages
+// channel. When the buffer is full, newly received messages are dropped rather
+// than blocking the connection, see Messages. The default is 100.
+func WithMessageBuffer(n int) Option {
+	return func(c *Client) { c.config.messageBuffer = atLeastOne(n) }
+}
+
+// WithHandlerBuffer sets the number of messages queued for each handler
+// registered with OnMessage. When a handler's queue is full, messages for it
+// are dropped. The default is 100.
+func WithHandlerBuffer(n int) Option {
+	return func(c *Client) { c.config.handlerBuffer = atLeastOne(n) }
+}
+
+// WithRoomHistory keeps the last n messages received in each room for
+// SearchRoom. By default no messages are kept.
+func WithRoomHistory(n int) Option {
+	return func(c *Client) { c.config.roomHistory = n }
+}
+
+// WithPauseBuffer sets the number of messages held back while delivery on
+// Messages is paused. When it is full, further messages are dropped. The
+// default is 1000.
+func WithPauseBuffer(n int) Option {
+	return func(c *Client) { c.config.pauseBuffer = atLeastOne(n) }
+}
+
+// WithRosterUpdateBuffer sets the number of roster pushes buffered on the
+// RosterUpdates channel. When the buffer is full, updates are dropped. The
+// default is 64.
+func WithRosterUpdateBuffer(n int) Option {
+	return func(c *Client) { c.config.rosterBuffer = atLeastOne(n) }
+}
+
+// WithMentionBuffer sets the number of messages buffered on the Mentions
+// channel. When the buffer is full, mentions are dropped. The default is 64.
+func WithMentionBuffer(n int) Option {
+	return func(c *Client) { c.config.mentionBuffer = atLeastOne(n) }
+}
+
+// WithSystemMessageBuffer sets the number of messages buffered on the
+// SystemMessages channel. When the buffer is full, messages are dropped. The
+// default is 64.
+func WithSystemMessageBuffer(n int) Option {
+	return func(c *Client) { c.config.systemBuffer = atLeastOne(n) }
+}
+
+// WithMessageErrorBuffer sets the number of messages buffered on the
+// MessageErrors channel. When the buffer is full, errors are dropped. The
+// default is 64.
+func WithMessageErrorBuffer(n int) Option {
+	return func(c *Client) { c.config.errorBuffer = atLeastOne(n) }
+}
+
+// WithMarkerBuffer sets the number of chat markers buffered on the Markers
+// channel. When the buffer is full, markers are dropped. The default is 64.
+func WithMarkerBuffer(n int) Option {
+	return func(c *Client) { c.config.markerBuffer = atLeastOne(n) }
+}
+
+// WithRoomStateBuffer sets the number of events buffered on the RoomStates
+// channel. When the buffer is full, events are dropped. The default is 64.
+func WithRoomStateBuffer(n int) Option {
+	return func(c *Client) { c.config.roomStateBuffer = atLeastOne(n) }
+}
+
+// WithOccupantEventBuffer sets the number of events buffered on the
+// OccupantEvents channel. When the buffer is full, events are dropped. The
+// default is 64.
+func WithOccupantEventBuffer(n int) Option {
+	return func(c *Client) { c.config.occupantBuffer = atLeastOne(n) }
+}
+
+// WithSubscriptionBuffer sets the number of events buffered on the
+// Subscriptions channel. When the buffer is full, events are dropped. The
+// default is 64.
+func WithSubscriptionBuffer(n int) Option {
+	return func(c *Client) { c.config.subscribeBuffer = atLeastOne(n) }
+}
+
+// WithConnectBuffer sets the number of notifications buffered on the OnConnect
+// channel. When the buffer is full, further notifications are dropped. The
+// default is 1.
+func WithConnectBuffer(n int) Option {
+	return func(c *Client) { c.config.connectBuffer = atLeastOne(n) }
+}
+
+// WithReconnectBuffer sets the number of notifications buffered on the
+// OnReconnect channel. When the buffer is full, further notifications are
+// dropped. The default is 8.
+func WithReconnectBuffer(n int) Option {
+	return func(c *Client) { c.config.reconnectBuffer = atLeastOne(n) }
+}
@@ -0,0 +1,238 @@
+// Package rest provides access to the parts of HipChat's v2 REST API that are
+// not available over XMPP. Requests are authenticated with an API access
+// token.
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/mackross/go-hipchat"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultBaseURL is the address of the HipChat Cloud API.
+const DefaultBaseURL = "https://api.hipchat.com"
+
+// pageSize is the largest max-results HipChat accepts for a history request.
+const pageSize = 1000
+
+// A Client makes authenticated requests to the HipChat REST API.
+type Client struct {
+	Token      string
+	BaseURL    string
+	HTTPClient *http.Client
+
+	mu   sync.Mutex
+	jids map[string]string // user id -> JID, shared by every request
+}
+
+// An Error is returned when HipChat responds with an error status.
+type Error struct {
+	Status  int
+	Type    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("hipchat: %d %s: %s", e.Status, e.Type, e.Message)
+}
+
+type historyItem struct {
+	Date    string          `json:"date"`
+	From    json.RawMessage `json:"from"`
+	Id      string          `json:"id"`
+	Message string          `json:"message"`
+	Type    string          `json:"type"`
+}
+
+type sender struct {
+	Id          json.Number `json:"id"`
+	Name        string      `json:"name"`
+	MentionName string      `json:"mention_name"`
+}
+
+// entity is the part of a room or user the client looks up.
+type entity struct {
+	XMPPJid string `json:"xmpp_jid"`
+}
+
+type history struct {
+	Items []*historyItem `json:"items"`
+	Links struct {
+		Next string `json:"next"`
+	} `json:"links"`
+}
+
+// NewClient creates a new Client for the HipChat Cloud API using the access
+// token passed to it.
+func NewClient(token string) *Client {
+	return &Client{Token: token, BaseURL: DefaultBaseURL, HTTPClient: http.DefaultClient}
+}
+
+// RoomHistory returns up to maxResults of the most recent messages sent to
+// room, which may be the room's id or name. Messages are returned oldest first.
+func (c *Client) RoomHistory(room string, maxResults int) ([]*hipchat.Message, error) {
+	return c.RoomHistoryBetween(room, time.Time{}, time.Now(), maxResults)
+}
+
+// RoomHistorySince returns up to maxResults of the most recent messages sent
+// to room after since. Messages are returned oldest first.
+func (c *Client) RoomHistorySince(room string, since time.Time, maxResults int) ([]*hipchat.Message, error) {
+	return c.RoomHistoryBetween(room, since, time.Now(), maxResults)
+}
+
+// RoomHistoryBetween returns up to maxResults of the most recent messages sent
+// to room between start and end. A zero start disables the lower bound.
+// Messages are returned oldest first, filled in as the XMPP client delivers
+// room messages, which takes a request for the room and one for each sender
+// the Client has not seen before to learn their JIDs.
+func (c *Client) RoomHistoryBetween(room string, start, end time.Time, maxResults int) ([]*hipchat.Message, error) {
+	var r entity
+	if err := c.get("/v2/room/"+url.PathEscape(room), nil, &r); err != nil {
+		return nil, err
+	}
+
+	var messages []*hipchat.Message
+	for len(messages) < maxResults {
+		n := maxResults - len(messages)
+		if n > pageSize {
+			n = pageSize
+		}
+
+		params := url.Values{}
+		params.Set("date", end.Format(time.RFC3339))
+		if !start.IsZero() {
+			params.Set("end-date", start.Format(time.RFC3339))
+		}
+		params.Set("start-index", strconv.Itoa(len(messages)))
+		params.Set("max-results", strconv.Itoa(n))
+		// newest first keeps the pages stable while new messages arrive
+		params.Set("reverse", "false")
+
+		var h history
+		if err := c.get("/v2/room/"+url.PathEscape(room)+"/history", params, &h); err != nil {
+			return nil, err
+		}
+
+		for _, item := range h.Items {
+			m, err := c.message(item, r.XMPPJid)
+			if err != nil {
+				return nil, err
+			}
+			messages = append(messages, m)
+		}
+
+		if len(h.Items) < n || h.Links.Next == "" {
+			break
+		}
+	}
+
+	if len(messages) > maxResults {
+		messages = messages[:maxResults]
+	}
+
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+// message returns i as a message in the room with the given JID, looking up
+// the JID of its sender unless the Client already knows it.
+func (c *Client) message(i *historyItem, roomJID string) (*hipchat.Message, error) {
+	t, err := time.Parse(time.RFC3339Nano, i.Date)
+	if err != nil {
+		return nil, err
+	}
+
+	// notifications are sent from a plain string rather than a user
+	var s sender
+	if err := json.Unmarshal(i.From, &s); err != nil {
+		if err := json.Unmarshal(i.From, &s.Name); err != nil {
+			return nil, err
+		}
+	}
+
+	var jid string
+	if id := s.Id.String(); id != "" {
+		if jid, err = c.userJID(id); err != nil {
+			return nil, err
+		}
+	}
+
+	// rooms name their occupants after the user's display name
+	return &hipchat.Message{
+		ID:          i.Id,
+		From:        roomJID + "/" + s.Name,
+		To:          roomJID,
+		Body:        i.Message,
+		Type:        "groupchat",
+		Room:        roomJID,
+		Nick:        s.Name,
+		SenderJID:   jid,
+		Name:        s.Name,
+		MentionName: s.MentionName,
+		Time:        t,
+	}, nil
+}
+
+// userJID returns the JID of the user with the given id, looking it up the
+// first time it is asked for.
+func (c *Client) userJID(id string) (string, error) {
+	c.mu.Lock()
+	jid, ok := c.jids[id]
+	c.mu.Unlock()
+	if ok {
+		return jid, nil
+	}
+
+	var u entity
+	if err := c.get("/v2/user/"+url.PathEscape(id), nil, &u); err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	if c.jids == nil {
+		c.jids = make(map[string]string)
+	}
+	c.jids[id] = u.XMPPJid
+	c.mu.Unlock()
+	return u.XMPPJid, nil
+}
+
+func (c *Client) get(path string, params url.Values, v interface{}) error {
+	u, err := url.Parse(c.BaseURL + path)
+	if err != nil {
+		return err
+	}
+	u.RawQuery = params.Encode()
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		var body struct {
+			Error struct {
+				Type    string `json:"type"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.NewDecoder(res.Body).Decode(&body)
+		return &Error{Status: res.StatusCode, Type: body.Error.Type, Message: body.Error.Message}
+	}
+
+	return json.NewDecoder(res.Body).Decode(v)
+}
@@ -0,0 +1,171 @@
+package rest
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoomHistory(t *testing.T) {
+	var userLookups int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/room/Dev":
+			fmt.Fprint(w, `{"id": 7, "name": "Dev", "xmpp_jid": "1_dev@conf.hipchat.com"}`)
+		case "/v2/user/2":
+			userLookups++
+			fmt.Fprint(w, `{"id": 2, "name": "Alice Smith", "mention_name": "alice", "xmpp_jid": "1_2@chat.hipchat.com"}`)
+		case "/v2/room/Dev/history":
+			// newest first, as requested
+			fmt.Fprint(w, `{"items": [
+				{"date": "2017-01-02T03:04:07+00:00", "from": "JIRA", "id": "c", "message": "build passed", "type": "notification"},
+				{"date": "2017-01-02T03:04:06+00:00", "from": {"id": 2, "name": "Alice Smith", "mention_name": "alice"}, "id": "b", "message": "again", "type": "message"},
+				{"date": "2017-01-02T03:04:05+00:00", "from": {"id": 2, "name": "Alice Smith", "mention_name": "alice"}, "id": "a", "message": "hi", "type": "message"}
+			], "links": {}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	c := NewClient("token")
+	c.BaseURL = server.URL
+	messages, err := c.RoomHistory("Dev", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 3 {
+		t.Fatalf("received %d messages, want 3", len(messages))
+	}
+
+	m := messages[0]
+	if m.ID != "a" || m.Body != "hi" || m.Type != "groupchat" {
+		t.Errorf("first message = %+v", m)
+	}
+	if m.From != "1_dev@conf.hipchat.com/Alice Smith" || m.Room != "1_dev@conf.hipchat.com" || m.Nick != "Alice Smith" {
+		t.Errorf("From = %q, Room = %q, Nick = %q", m.From, m.Room, m.Nick)
+	}
+	if m.SenderJID != "1_2@chat.hipchat.com" || m.Name != "Alice Smith" || m.MentionName != "alice" {
+		t.Errorf("SenderJID = %q, Name = %q, MentionName = %q", m.SenderJID, m.Name, m.MentionName)
+	}
+	if userLookups != 1 {
+		t.Errorf("looked up the sender %d times, want 1", userLookups)
+	}
+
+	if n := messages[2]; n.From != "1_dev@conf.hipchat.com/JIRA" || n.Name != "JIRA" || n.SenderJID != "" {
+		t.Errorf("notification = %+v", n)
+	}
+}
+
+func TestRoomHistoryPages(t *testing.T) {
+	var queries []string
+	var userLookups int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/room/Dev":
+			if r.URL.RawQuery != "" || strings.Contains(r.RequestURI, "?") {
+				t.Errorf("room lookup sent query %q", r.RequestURI)
+			}
+			fmt.Fprint(w, `{"id": 7, "name": "Dev", "xmpp_jid": "1_dev@conf.hipchat.com"}`)
+		case "/v2/user/2":
+			userLookups++
+			fmt.Fprint(w, `{"id": 2, "name": "Alice Smith", "mention_name": "alice", "xmpp_jid": "1_2@chat.hipchat.com"}`)
+		case "/v2/room/Dev/history":
+			queries = append(queries, r.URL.RawQuery)
+			q := r.URL.Query()
+			start, _ := strconv.Atoi(q.Get("start-index"))
+			n, _ := strconv.Atoi(q.Get("max-results"))
+			// 1200 messages in all, numbered newest first
+			var items []string
+			for i := start; i < start+n && i < 1200; i++ {
+				items = append(items, fmt.Sprintf(`{"date": "2017-01-02T03:04:05+00:00", "from": {"id": 2, "name": "Alice Smith"}, "id": "%d", "message": "m", "type": "message"}`, i))
+			}
+			next := ""
+			if start+len(items) < 1200 {
+				next = `"next": "more"`
+			}
+			fmt.Fprintf(w, `{"items": [%s], "links": {%s}}`, strings.Join(items, ","), next)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	c := NewClient("token")
+	c.BaseURL = server.URL
+	messages, err := c.RoomHistory("Dev", 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1200 {
+		t.Fatalf("received %d messages, want 1200", len(messages))
+	}
+	if messages[0].ID != "1199" || messages[1199].ID != "0" {
+		t.Errorf("first = %s, last = %s", messages[0].ID, messages[1199].ID)
+	}
+	if len(queries) != 2 {
+		t.Fatalf("requested %d pages, want 2", len(queries))
+	}
+	second, _ := url.ParseQuery(queries[1])
+	if second.Get("start-index") != "1000" || second.Get("max-results") != "500" {
+		t.Errorf("second page query = %q", queries[1])
+	}
+
+	// the sender's JID is remembered between calls
+	if _, err := c.RoomHistory("Dev", 1); err != nil {
+		t.Fatal(err)
+	}
+	if userLookups != 1 {
+		t.Errorf("looked up the sender %d times, want 1", userLookups)
+	}
+}
+
+func TestRoomHistoryDates(t *testing.T) {
+	var query url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/room/Dev":
+			fmt.Fprint(w, `{"id": 7, "name": "Dev", "xmpp_jid": "1_dev@conf.hipchat.com"}`)
+		case "/v2/room/Dev/history":
+			query = r.URL.Query()
+			fmt.Fprint(w, `{"items": [], "links": {}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	c := NewClient("token")
+	c.BaseURL = server.URL
+	start := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	end := time.Date(2017, 2, 3, 4, 5, 6, 0, time.UTC)
+
+	if _, err := c.RoomHistoryBetween("Dev", start, end, 10); err != nil {
+		t.Fatal(err)
+	}
+	if query.Get("date") != "2017-02-03T04:05:06Z" || query.Get("end-date") != "2017-01-02T03:04:05Z" {
+		t.Errorf("RoomHistoryBetween query = %v", query)
+	}
+	if query.Get("reverse") != "false" || query.Get("max-results") != "10" {
+		t.Errorf("RoomHistoryBetween query = %v", query)
+	}
+
+	if _, err := c.RoomHistorySince("Dev", start, 10); err != nil {
+		t.Fatal(err)
+	}
+	if query.Get("end-date") != "2017-01-02T03:04:05Z" || query.Get("date") == "" {
+		t.Errorf("RoomHistorySince query = %v", query)
+	}
+
+	if _, err := c.RoomHistory("Dev", 10); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := query["end-date"]; ok {
+		t.Errorf("RoomHistory query = %v", query)
+	}
+}
@@ -0,0 +1,150 @@
+package hipchat
+
+import (
+	"time"
+)
+
+// A Schedule is a message scheduled to be said with SayAt or SayEvery.
+type Schedule struct {
+	c       *Client
+	to      string
+	name    string
+	body    string
+	every   time.Duration // zero for a message said once
+	timer   *time.Timer
+	stopped bool // guarded by c.mu
+}
+
+// SayAt says body to a room or user like Say at t, or straight away if t has
+// passed. If the client is not connected when the message comes due, such as
+// while it is reconnecting, the message is said once the client has
+// reconnected. Scheduled messages are dropped by Disconnect and Close.
+func (c *Client) SayAt(t time.Time, to, name, body string) *Schedule {
+	return c.schedule(time.Until(t), 0, to, name, body)
+}
+
+// SayEvery says body to a room or user like Say every interval, starting one
+// interval from now, until the Schedule is stopped or the client is
+// disconnected. A message that comes due while the client is not connected is
+// said once it has reconnected, only once however many intervals the outage
+// lasted. It returns ErrInvalidInterval if interval is not positive.
+func (c *Client) SayEvery(interval time.Duration, to, name, body string) (*Schedule, error) {
+	if interval <= 0 {
+		return nil, ErrInvalidInterval
+	}
+	return c.schedule(interval, interval, to, name, body), nil
+}
+
+// Stop cancels the message, or for SayEvery all messages still to come,
+// including one waiting for the client to reconnect. A message already being
+// said is not affected.
+func (s *Schedule) Stop() {
+	c := s.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s.stopped = true
+	s.timer.Stop()
+	delete(c.schedules, s)
+	for i, o := range c.overdue {
+		if o == s {
+			c.overdue = append(c.overdue[:i], c.overdue[i+1:]...)
+			break
+		}
+	}
+}
+
+func (c *Client) schedule(delay, every time.Duration, to, name, body string) *Schedule {
+	s := &Schedule{c: c, to: to, name: name, body: body, every: every}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s.timer = time.AfterFunc(delay, func() { c.due(s) })
+	if c.closed() {
+		s.timer.Stop()
+		s.stopped = true
+		return s
+	}
+	c.schedules[s] = true
+	return s
+}
+
+// due is called when s comes due, and schedules its next message, if any,
+// before saying it.
+func (c *Client) due(s *Schedule) {
+	c.mu.Lock()
+	if s.stopped || c.closed() {
+		c.mu.Unlock()
+		return
+	}
+	if s.every > 0 {
+		s.timer.Reset(s.every)
+	} else {
+		delete(c.schedules, s)
+	}
+	c.mu.Unlock()
+	c.sayScheduled(s)
+}
+
+// sayScheduled says the message of s, or keeps it to be said after the client
+// reconnects if it cannot.
+func (c *Client) sayScheduled(s *Schedule) {
+	for {
+		err := c.Say(s.to, s.name, s.body)
+		if err == nil {
+			return
+		}
+		if err == ErrNoEcho {
+			c.log("Scheduled message to", s.to, "was not echoed")
+			return
+		}
+
+		c.mu.Lock()
+		// the client may have reconnected, and said what was overdue, since
+		// Say found it disconnected
+		if err == ErrNotConnected && c.connected {
+			c.mu.Unlock()
+			continue
+		}
+		if !s.stopped && !c.closed() && !c.isOverdue(s) {
+			c.overdue = append(c.overdue, s)
+		}
+		c.mu.Unlock()
+		return
+	}
+}
+
+// isOverdue reports whether s is waiting for the client to reconnect. c.mu
+// must be held.
+func (c *Client) isOverdue(s *Schedule) bool {
+	for _, o := range c.overdue {
+		if o == s {
+			return true
+		}
+	}
+	return false
+}
+
+// sayOverdue says the scheduled messages that came due while the client was
+// not connected, in the order they came due.
+func (c *Client) sayOverdue() {
+	c.mu.Lock()
+	overdue := c.overdue
+	c.overdue = nil
+	c.mu.Unlock()
+	for _, s := range overdue {
+		c.sayScheduled(s)
+	}
+}
+
+// stopSchedules stops every scheduled message when the client is
+// disconnected. c.mu must be held.
+func (c *Client) stopSchedules() {
+	for s := range c.schedules {
+		s.stopped = true
+		s.timer.Stop()
+	}
+	for _, s := range c.overdue {
+		s.stopped = true
+	}
+	c.schedules = make(map[*Schedule]bool)
+	c.overdue = nil
+}
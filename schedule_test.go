@@ -0,0 +1,74 @@
+package hipchat
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mackross/go-hipchat/hipchattest"
+)
+
+func TestSayAt(t *testing.T) {
+	server := hipchattest.NewServer(append(hipchattest.Login(),
+		hipchattest.Step{Expect: "<body>now</body>"},
+		hipchattest.Step{Expect: "<body>later</body>"},
+	)...)
+	c := connect(t, server)
+
+	start := time.Now()
+	c.SayAt(start.Add(-time.Minute), "1_2@chat.hipchat.com", "Bot", "now")
+	c.SayAt(start.Add(50*time.Millisecond), "1_2@chat.hipchat.com", "Bot", "later")
+	c.SayAt(start.Add(50*time.Millisecond), "1_2@chat.hipchat.com", "Bot", "never").Stop()
+	waitFor(t, "the scheduled messages", func() bool { return len(server.Received()) == 5 })
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("said the later message after %v", d)
+	}
+
+	time.Sleep(100 * time.Millisecond) // past the stopped message
+	if n := len(server.Received()); n != 5 {
+		t.Errorf("received %d stanzas, want 5", n)
+	}
+	if err := server.Err(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSayEvery(t *testing.T) {
+	server := hipchattest.NewServer(append(hipchattest.Login(),
+		hipchattest.Step{Expect: "<body>tick</body>"},
+		hipchattest.Step{Expect: "<body>tick</body>"},
+	)...)
+	c := connect(t, server)
+
+	if _, err := c.SayEvery(0, "1_2@chat.hipchat.com", "Bot", "tick"); err != ErrInvalidInterval {
+		t.Errorf("SayEvery(0) error = %v, want ErrInvalidInterval", err)
+	}
+
+	s, err := c.SayEvery(20*time.Millisecond, "1_2@chat.hipchat.com", "Bot", "tick")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "two ticks", func() bool { return len(server.Received()) == 5 })
+	s.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+	if n := len(server.Received()); n != 5 {
+		t.Errorf("received %d stanzas after Stop, want 5", n)
+	}
+}
+
+func TestSayAtWhileReconnecting(t *testing.T) {
+	server := hipchattest.NewServer(hipchattest.Login()...).
+		Then(append(hipchattest.Login(), hipchattest.Step{Expect: "<body>overdue</body>"})...)
+	c := connect(t, server)
+
+	server.Drop()
+	time.Sleep(50 * time.Millisecond) // into the delay before reconnecting
+	c.SayAt(time.Now(), "1_2@chat.hipchat.com", "Bot", "overdue")
+
+	// said once, after reconnecting
+	waitFor(t, "the overdue message", func() bool { return len(server.Received()) == 7 })
+	time.Sleep(50 * time.Millisecond)
+	if n := len(server.Received()); n != 7 {
+		t.Errorf("received %d stanzas, want 7", n)
+	}
+}
@@ -0,0 +1,83 @@
+package hipchat
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// A Store keeps the time of the last message the client saw in each room, so
+// that after the process restarts the client can ask rooms for the messages it
+// missed, see WithStore. Load returns the zero time for a room it has nothing
+// for.
+type Store interface {
+	Load(roomId string) (time.Time, error)
+	Save(roomId string, lastSeen time.Time) error
+}
+
+// A FileStore is a Store that keeps the times in a JSON file.
+type FileStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewFileStore returns a FileStore keeping the times in the file at path,
+// which is created when a time is first saved.
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+// Load returns the time saved for a room.
+func (s *FileStore) Load(roomId string) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	times, err := s.read()
+	return times[roomId], err
+}
+
+// Save records the time for a room, replacing the file so that a crash part
+// way through leaves the previous times intact.
+func (s *FileStore) Save(roomId string, lastSeen time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	times, err := s.read()
+	if err != nil {
+		return err
+	}
+	times[roomId] = lastSeen
+
+	b, err := json.Marshal(times)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// read returns the times in the file, none if it does not exist yet.
+func (s *FileStore) read() (map[string]time.Time, error) {
+	times := make(map[string]time.Time)
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return times, nil
+	}
+	if err != nil {
+		return times, err
+	}
+	return times, json.Unmarshal(b, &times)
+}
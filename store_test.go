@@ -0,0 +1,77 @@
+package hipchat
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mackross/go-hipchat/hipchattest"
+)
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hipchat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "seen.json")
+
+	// a missing file holds no times
+	s := NewFileStore(path)
+	if seen, err := s.Load("dev"); err != nil || !seen.IsZero() {
+		t.Errorf("Load() = %v, %v before saving", seen, err)
+	}
+
+	dev := time.Date(2017, 1, 2, 3, 4, 5, 500000000, time.UTC)
+	ops := dev.Add(time.Hour)
+	if err := s.Save("dev", dev); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save("ops", ops); err != nil {
+		t.Fatal(err)
+	}
+
+	// the times survive reopening the file
+	s = NewFileStore(path)
+	for room, want := range map[string]time.Time{"dev": dev, "ops": ops, "qa": {}} {
+		if seen, err := s.Load(room); err != nil || !seen.Equal(want) {
+			t.Errorf("Load(%q) = %v, %v, want %v", room, seen, err, want)
+		}
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("%d files left in the directory, want 1", len(files))
+	}
+}
+
+func TestFileStoreRejoinRepeatsLastSecond(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hipchat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "seen.json")
+
+	const room = "1_dev@conf.hipchat.com"
+	message := "<message from='" + room + "/alice' to='user@chat.hipchat.com/bot' type='groupchat' id='m1'>" +
+		"<body>hi</body><delay xmlns='urn:xmpp:delay' stamp='2017-01-02T03:04:05.5Z'/></message>"
+
+	server := hipchattest.NewServer(append(hipchattest.Login(), hipchattest.Step{Reply: message})...)
+	c := connect(t, server, WithStore(NewFileStore(path)))
+	receive(t, c.Messages())
+	c.Disconnect()
+
+	// after a restart the room is asked for the messages since the second
+	// the last one was seen in, which includes that message again
+	server = hipchattest.NewServer(append(hipchattest.Login(),
+		hipchattest.Step{Expect: "since='2017-01-02T03:04:05Z'", Reply: message},
+	)...)
+	c = connect(t, server, WithStore(NewFileStore(path)))
+	if err := c.Join(room, "Bot"); err != nil {
+		t.Fatal(err)
+	}
+	if m := receive(t, c.Messages()); m.Body != "hi" || !m.Delayed {
+		t.Errorf("received %+v, want the message seen before the restart", m)
+	}
+}
@@ -0,0 +1,87 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+)
+
+var (
+	// ErrStanzaTooLarge is returned when a stanza is longer than the limit
+	// set with SetLimits.
+	ErrStanzaTooLarge = errors.New("stanza too large")
+
+	// ErrStanzaTooDeep is returned when a stanza nests elements more deeply
+	// than the limit set with SetLimits.
+	ErrStanzaTooDeep = errors.New("stanza nested too deeply")
+)
+
+// SetLimits bounds the stanzas the connection reads to about maxSize bytes
+// and maxDepth levels of elements, counting the stream as the first, so that a
+// misbehaving server cannot make the decoder allocate without limit. Reading
+// fails with ErrStanzaTooLarge or ErrStanzaTooDeep when a stanza exceeds them.
+// Zero means no limit, which is the default. It must be called before
+// anything is read.
+func (c *Conn) SetLimits(maxSize int64, maxDepth int) {
+	c.maxSize = maxSize
+	c.maxDepth = maxDepth
+}
+
+// newDecoder starts decoding the stream read from r.
+func (c *Conn) newDecoder(r io.Reader) {
+	c.raw = xml.NewDecoder(&limitReader{Reader: r, c: c})
+	c.incoming = xml.NewTokenDecoder(limitedTokens{c})
+	c.depth = 0
+	c.stanzaStart = 0
+}
+
+// limitReader fails once more than the maximum size has been read since the
+// current stanza began. The decoder reads ahead, so a stanza can exceed the
+// limit by as much as the decoder buffers.
+type limitReader struct {
+	io.Reader
+	c *Conn
+	n int64
+}
+
+func (lr *limitReader) Read(b []byte) (int, error) {
+	if max := lr.c.maxSize; max > 0 && lr.n-lr.c.stanzaStart > max {
+		return 0, ErrStanzaTooLarge
+	}
+	n, err := lr.Reader.Read(b)
+	lr.n += int64(n)
+	return n, err
+}
+
+// limitedTokens passes on the tokens of the raw decoder, tracking how deeply
+// they are nested and where the current stanza began.
+type limitedTokens struct {
+	c *Conn
+}
+
+func (lt limitedTokens) Token() (xml.Token, error) {
+	c := lt.c
+	t, err := c.raw.Token()
+	if err != nil {
+		return t, err
+	}
+
+	switch e := t.(type) {
+	case xml.StartElement:
+		if e.Name.Space == NsStream && e.Name.Local == "stream" {
+			// a stream restarted after SASL opens inside the old one
+			c.depth = 0
+		}
+		c.depth++
+		if c.maxDepth > 0 && c.depth > c.maxDepth {
+			return nil, ErrStanzaTooDeep
+		}
+	case xml.EndElement:
+		c.depth--
+	}
+	if c.depth <= 1 {
+		// between stanzas
+		c.stanzaStart = c.raw.InputOffset()
+	}
+	return t, nil
+}
@@ -0,0 +1,69 @@
+package xmpp
+
+import (
+	"bytes"
+	"net"
+)
+
+type Direction int
+
+const (
+	Inbound Direction = iota
+	Outbound
+)
+
+type Tracer func(dir Direction, stanza []byte)
+
+// tracingConn hands the stanzas written to the connection to the tracer and
+// keeps what is read until the decoder has consumed a whole stanza. It sits
+// above any TLS layer so stanzas are traced in the clear.
+type tracingConn struct {
+	net.Conn
+	c *Conn
+}
+
+func (tc *tracingConn) Read(b []byte) (int, error) {
+	n, err := tc.Conn.Read(b)
+	if tc.c.tracer() != nil {
+		tc.c.inbound.Write(b[:n])
+	}
+	return n, err
+}
+
+func (tc *tracingConn) Write(b []byte) (int, error) {
+	if t := tc.c.tracer(); t != nil && len(bytes.TrimSpace(b)) != 0 {
+		t(Outbound, append([]byte(nil), b...))
+	}
+	return tc.Conn.Write(b)
+}
+
+func (c *Conn) SetTracer(t Tracer) {
+	c.trace.Store(t)
+}
+
+func (c *Conn) tracer() Tracer {
+	t, _ := c.trace.Load().(Tracer)
+	return t
+}
+
+// traceIn passes everything the decoder has consumed since it was last called
+// to the tracer.
+func (c *Conn) traceIn() {
+	t := c.tracer()
+	if t == nil {
+		c.inbound.Reset()
+		return
+	}
+
+	offset := c.raw.InputOffset()
+	n := int(offset - c.traced)
+	if n > c.inbound.Len() {
+		// the tracer was set part way through a stanza
+		n = c.inbound.Len()
+	}
+	b := bytes.TrimSpace(c.inbound.Next(n))
+	c.traced = offset
+	if len(b) != 0 {
+		t(Inbound, append([]byte(nil), b...))
+	}
+}
@@ -1,6 +1,7 @@
 package xmpp
 
 import (
+	"bytes"
 	"crypto/rand"
 	"crypto/tls"
 	"encoding/xml"
@@ -9,161 +10,879 @@ import (
 	"html"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
 	NsJabberClient = "jabber:client"
 	NsStream       = "http://etherx.jabber.org/streams"
+	NsStreams      = "urn:ietf:params:xml:ns:xmpp-streams"
 	NsIqAuth       = "jabber:iq:auth"
 	NsIqRoster     = "jabber:iq:roster"
 	NsTLS          = "urn:ietf:params:xml:ns:xmpp-tls"
+	NsSASL         = "urn:ietf:params:xml:ns:xmpp-sasl"
+	NsBind         = "urn:ietf:params:xml:ns:xmpp-bind"
 	NsDisco        = "http://jabber.org/protocol/disco#items"
+	NsDiscoInfo    = "http://jabber.org/protocol/disco#info"
+	NsCaps         = "http://jabber.org/protocol/caps"
+	NsIqLast       = "jabber:iq:last"
+	NsIqVersion    = "jabber:iq:version"
+	NsTime         = "urn:xmpp:time"
 	NsMuc          = "http://jabber.org/protocol/muc"
-
-	xmlStream      = "<stream:stream from='%s' to='%s' version='1.0' xml:lang='en' xmlns='%s' xmlns:stream='%s'>"
+	NsMucUser      = "http://jabber.org/protocol/muc#user"
+	NsCorrect      = "urn:xmpp:message-correct:0"
+	NsDelay        = "urn:xmpp:delay"
+	NsPing         = "urn:xmpp:ping"
+	NsStanzas      = "urn:ietf:params:xml:ns:xmpp-stanzas"
+	NsChatMarkers  = "urn:xmpp:chat-markers:0"
+	NsReceipts     = "urn:xmpp:receipts"
+	NsCarbons      = "urn:xmpp:carbons:2"
+	NsReply        = "urn:xmpp:reply:0"
+
+	xmlStream      = "<stream:stream%s to='%s' version='1.0' xml:lang='en' xmlns='%s' xmlns:stream='%s'>"
+	xmlStreamEnd   = "</stream:stream>"
 	xmlStartTLS    = "<starttls xmlns='%s'/>"
-	xmlIqSet       = "<iq type='set' id='%s'><query xmlns='%s'><username>%s</username><password>%s</password><resource>%s</resource></query></iq>"
-	xmlIqGet       = "<iq from='%s' to='%s' id='%s' type='get'><query xmlns='%s'/></iq>"
-	xmlPresence    = "<presence from='%s'><show>%s</show></presence>"
-	xmlMUCPresence = "<presence id='%s' to='%s' from='%s'><x xmlns='%s'/></presence>"
-	xmlMUCMessage  = "<message from='%s' id='%s' to='%s' type='groupchat'><body>%s</body></message>"
-	xmlMessage     = "<message from='%s' id='%s' to='%s' type='chat'><body>%s</body></message>"
+	xmlSASLAuth    = "<auth xmlns='%s' mechanism='%s'>%s</auth>"
+	xmlBind        = "<bind xmlns='%s'><resource>%s</resource></bind>"
+	xmlIqSet       = "<iq type='set' id='%s' xmlns='%s'><query xmlns='%s'><username>%s</username><password>%s</password><resource>%s</resource></query></iq>"
+	xmlIqGet       = "<iq from='%s' to='%s' id='%s' type='get' xmlns='%s'><query xmlns='%s'/></iq>"
+	xmlIqGetNode   = "<iq from='%s' to='%s' id='%s' type='get' xmlns='%s'><query xmlns='%s' node='%s'/></iq>"
+	xmlIq          = "<iq%s id='%s' type='%s' xmlns='%s'>%s</iq>"
+	xmlPing        = "<ping xmlns='%s'/>"
+	xmlCarbons     = "<enable xmlns='%s'/>"
+	xmlVersion     = "<query xmlns='%s'><name>%s</name><version>%s</version></query>"
+	xmlTime        = "<time xmlns='%s'><tzo>%s</tzo><utc>%s</utc></time>"
+	xmlPresence    = "<presence from='%s' xmlns='%s'><show>%s</show></presence>"
+	xmlStatus      = "<presence from='%s' xmlns='%s'><show>%s</show><status>%s</status></presence>"
+	xmlUnavailable = "<presence from='%s' type='unavailable' xmlns='%s'/>"
+	xmlSubscribe   = "<presence from='%s' to='%s' type='%s' xmlns='%s'/>"
+	xmlMUCStatus   = "<presence from='%s' to='%s' xmlns='%s'><show>%s</show><status>%s</status></presence>"
+	xmlMUCPresence = "<presence id='%s' to='%s' from='%s' xmlns='%s'><x xmlns='%s'/></presence>"
+	xmlMUCPart     = "<presence id='%s' to='%s' from='%s' type='unavailable' xmlns='%s'/>"
+	xmlMUCJoin     = "<presence id='%s' to='%s' from='%s' xmlns='%s'><x xmlns='%s'>%s</x></presence>"
+	xmlMessage     = "<message from='%s' id='%s' to='%s' type='%s' xmlns='%s'><body>%s</body>%s</message>"
+	xmlReplace     = "<replace id='%s' xmlns='%s'/>"
+	xmlReply       = "<reply id='%s' xmlns='%s'/>"
+	xmlMUCSubject  = "<message from='%s' id='%s' to='%s' type='groupchat' xmlns='%s'><subject>%s</subject></message>"
+	xmlMarker      = "<message from='%s' id='%s' to='%s' type='%s' xmlns='%s'><%s id='%s' xmlns='%s'/></message>"
 )
 
 type required struct{}
 
 type features struct {
 	XMLName    xml.Name  `xml:"features"`
-	StartTLS   *required `xml:"starttls>required"`
+	StartTLS   *startTLS `xml:"starttls"`
 	Mechanisms []string  `xml:"mechanisms>mechanism"`
+	Caps       *Caps     `xml:"http://jabber.org/protocol/caps c"`
+}
+
+// Caps are the entity capabilities (XEP-0115) an entity advertises: Ver
+// identifies its set of features, which disco#info on the node Node + "#" +
+// Ver returns. Hash names the hash function Ver was computed with.
+type Caps struct {
+	Hash string `xml:"hash,attr"`
+	Node string `xml:"node,attr"`
+	Ver  string `xml:"ver,attr"`
+}
+
+// saslFailure is the failure a server answers a SASL exchange with.
+type saslFailure struct {
+	Conditions []*condition `xml:",any"`
+	Text       string       `xml:"text"`
+}
+
+type startTLS struct {
+	Required *required `xml:"required"`
 }
 
 type item struct {
-	Jid         string `xml:"jid,attr"`
-	Name        string `xml:"name,attr"`
-	MentionName string `xml:"mention_name,attr"`
+	Jid          string   `xml:"jid,attr"`
+	Name         string   `xml:"name,attr"`
+	MentionName  string   `xml:"mention_name,attr"`
+	Subscription string   `xml:"subscription,attr"`
+	Groups       []string `xml:"group"`
 }
 
 type query struct {
+	XMLName    xml.Name    `xml:"query"`
+	Items      []*item     `xml:"item"`
+	Identities []*identity `xml:"identity"`
+	Features   []*feature  `xml:"feature"`
+	Seconds    int64       `xml:"seconds,attr"`
+}
+
+type identity struct {
+	Category string `xml:"category,attr"`
+	Type     string `xml:"type,attr"`
+	Name     string `xml:"name,attr"`
+}
+
+type feature struct {
+	Var string `xml:"var,attr"`
+}
+
+type IQ struct {
+	XMLName xml.Name     `xml:"iq"`
+	ID      string       `xml:"id,attr"`
+	Type    string       `xml:"type,attr"`
+	From    string       `xml:"from,attr"`
+	Query   *query       `xml:"query"`
+	Bind    *bind        `xml:"bind"`
+	Ping    *struct{}    `xml:"urn:xmpp:ping ping"`
+	Time    *struct{}    `xml:"urn:xmpp:time time"`
+	Error   *StanzaError `xml:"error"`
+}
+
+// rosterIQ is an iq whose roster items are passed to a function as they are
+// decoded, see RosterStream.
+type rosterIQ struct {
+	XMLName xml.Name     `xml:"iq"`
+	ID      string       `xml:"id,attr"`
+	Type    string       `xml:"type,attr"`
+	From    string       `xml:"from,attr"`
+	Query   *rosterQuery `xml:"jabber:iq:roster query"`
+	Error   *StanzaError `xml:"error"`
+}
+
+type rosterQuery struct {
 	XMLName xml.Name `xml:"query"`
-	Items   []*item  `xml:"item"`
+	Items   itemFunc `xml:"item"`
+}
+
+// itemFunc is called with each item decoded into it instead of keeping them.
+type itemFunc func(*item)
+
+func (f itemFunc) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	i := new(item)
+	if err := d.DecodeElement(i, &start); err != nil {
+		return err
+	}
+	f(i)
+	return nil
+}
+
+type StanzaError struct {
+	Type       string       `xml:"type,attr"`
+	Conditions []*condition `xml:",any"`
+	Text       string       `xml:"text"`
+}
+
+func (e *StanzaError) Condition() string {
+	for _, cond := range e.Conditions {
+		if cond.XMLName.Space == NsStanzas {
+			return cond.XMLName.Local
+		}
+	}
+	return ""
+}
+
+type bind struct {
+	Jid string `xml:"jid"`
+}
+
+type condition struct {
+	XMLName xml.Name
+}
+
+type streamError struct {
+	XMLName    xml.Name     `xml:"error"`
+	Conditions []*condition `xml:",any"`
+	Text       string       `xml:"text"`
+	Condition  string       `xml:"-"`
+}
+
+type presence struct {
+	XMLName xml.Name     `xml:"presence"`
+	ID      string       `xml:"id,attr"`
+	Type    string       `xml:"type,attr"`
+	From    string       `xml:"from,attr"`
+	To      string       `xml:"to,attr"`
+	Show    string       `xml:"show"`
+	Status  string       `xml:"status"`
+	MUCUser *mucUser     `xml:"http://jabber.org/protocol/muc#user x"`
+	Delay   *delay       `xml:"urn:xmpp:delay delay"`
+	Caps    *Caps        `xml:"http://jabber.org/protocol/caps c"`
+	Error   *StanzaError `xml:"error"`
+}
+
+type mucUser struct {
+	Item     *mucItem    `xml:"item"`
+	Statuses []mucStatus `xml:"status"`
+}
+
+type mucItem struct {
+	Jid         string `xml:"jid,attr"`
+	Affiliation string `xml:"affiliation,attr"`
+	Role        string `xml:"role,attr"`
+}
+
+type mucStatus struct {
+	Code int `xml:"code,attr"`
+}
+
+// Item returns the occupant's affiliation and role from a room's presence,
+// empty if the presence has none.
+func (p *presence) Item() (affiliation, role string) {
+	if p.MUCUser == nil || p.MUCUser.Item == nil {
+		return "", ""
+	}
+	return p.MUCUser.Item.Affiliation, p.MUCUser.Item.Role
+}
+
+// StatusCodes returns the status codes of a room's presence.
+func (p *presence) StatusCodes() []int {
+	if p.MUCUser == nil {
+		return nil
+	}
+	codes := make([]int, len(p.MUCUser.Statuses))
+	for i, s := range p.MUCUser.Statuses {
+		codes[i] = s.Code
+	}
+	return codes
+}
+
+// RealJID returns the JID of the user behind a room occupant's presence, or an
+// empty string if the room does not reveal it.
+func (p *presence) RealJID() string {
+	if p.MUCUser == nil || p.MUCUser.Item == nil {
+		return ""
+	}
+	return p.MUCUser.Item.Jid
+}
+
+// Sent returns when the presence was originally sent, from its delay
+// (XEP-0203), or the zero time if it has none.
+func (p *presence) Sent() time.Time {
+	if p.Delay == nil {
+		return time.Time{}
+	}
+	t, _ := time.Parse(time.RFC3339Nano, p.Delay.Stamp)
+	return t
+}
+
+// SelfPresence reports whether the presence is a room reflecting our own
+// presence back to us, status code 110.
+func (p *presence) SelfPresence() bool {
+	if p.MUCUser == nil {
+		return false
+	}
+	for _, s := range p.MUCUser.Statuses {
+		if s.Code == 110 {
+			return true
+		}
+	}
+	return false
+}
+
+type message struct {
+	XMLName xml.Name     `xml:"message"`
+	ID      string       `xml:"id,attr"`
+	Mid     string       `xml:"mid,attr"`
+	Type    string       `xml:"type,attr"`
+	From    string       `xml:"from,attr"`
+	To      string       `xml:"to,attr"`
+	Body    string       `xml:"body"`
+	Subject *string      `xml:"subject"`
+	Replace *replace     `xml:"urn:xmpp:message-correct:0 replace"`
+	Reply   *replace     `xml:"urn:xmpp:reply:0 reply"`
+	Card    *card        `xml:"card"`
+	File    *file        `xml:"x>file"`
+	Delay   *delay       `xml:"urn:xmpp:delay delay"`
+	Error   *StanzaError `xml:"error"`
+
+	Markable     *struct{} `xml:"urn:xmpp:chat-markers:0 markable"`
+	Received     *marker   `xml:"urn:xmpp:chat-markers:0 received"`
+	Displayed    *marker   `xml:"urn:xmpp:chat-markers:0 displayed"`
+	Acknowledged *marker   `xml:"urn:xmpp:chat-markers:0 acknowledged"`
+
+	ReceiptRequest *struct{} `xml:"urn:xmpp:receipts request"`
+
+	CarbonSent     *carbon `xml:"urn:xmpp:carbons:2 sent"`
+	CarbonReceived *carbon `xml:"urn:xmpp:carbons:2 received"`
+}
+
+type carbon struct {
+	Message *message `xml:"forwarded>message"`
+}
+
+// Carbon returns the message forwarded in a message carbon, or nil if the
+// message is not a carbon.
+func (m *message) Carbon() *message {
+	switch {
+	case m.CarbonSent != nil:
+		return m.CarbonSent.Message
+	case m.CarbonReceived != nil:
+		return m.CarbonReceived.Message
+	}
+	return nil
+}
+
+type marker struct {
+	ID string `xml:"id,attr"`
+}
+
+// Marker returns the type of the chat marker the message carries and the id of
+// the message it marks, or empty strings if it carries none.
+func (m *message) Marker() (typ, id string) {
+	switch {
+	case m.Received != nil:
+		return "received", m.Received.ID
+	case m.Displayed != nil:
+		return "displayed", m.Displayed.ID
+	case m.Acknowledged != nil:
+		return "acknowledged", m.Acknowledged.ID
+	}
+	return "", ""
+}
+
+type delay struct {
+	Stamp string `xml:"stamp,attr"`
+}
+
+type card struct {
+	Style       string `xml:"style,attr"`
+	Title       string `xml:"title"`
+	Description string `xml:"description"`
+	URL         string `xml:"url"`
+	Icon        struct {
+		URL string `xml:"url,attr"`
+	} `xml:"icon"`
+	Thumbnail struct {
+		URL string `xml:"url,attr"`
+	} `xml:"thumbnail"`
+	Activity struct {
+		HTML string `xml:"html,attr"`
+	} `xml:"activity"`
 }
 
-type body struct {
-	Body string `xml:",innerxml"`
+type file struct {
+	Name     string `xml:"name"`
+	Size     int64  `xml:"size"`
+	URL      string `xml:"url"`
+	ThumbURL string `xml:"thumb_url"`
+}
+
+type replace struct {
+	ID string `xml:"id,attr"`
 }
 
 type Conn struct {
 	incoming *xml.Decoder
+	raw      *xml.Decoder // beneath incoming, see newDecoder
 	outgoing net.Conn
+	mu       sync.Mutex // guards outgoing, which UseTLS replaces, for out
+	read     int64
+	written  int64
+	trace    atomic.Value
+	inbound  bytes.Buffer // read but not yet traced
+	traced   int64        // input offset up to which inbound was traced
+	err      error        // first error reading the stream
+	ids      IDGenerator
+	socket   net.Conn
+
+	maxSize     int64
+	maxDepth    int
+	depth       int   // of the last token read
+	stanzaStart int64 // input offset at which the current stanza began
+}
+
+// An IDGenerator makes the ids of the stanzas a Conn sends, which are random
+// unless one is set with SetIDGenerator.
+type IDGenerator interface {
+	NewID() string
+}
+
+// SetIDGenerator makes the connection take stanza ids from g. It must be
+// called before anything is sent.
+func (c *Conn) SetIDGenerator(g IDGenerator) {
+	c.ids = g
+}
+
+// NewID returns a new stanza id, for requests whose reply must be expected
+// before they are sent.
+func (c *Conn) NewID() string {
+	return c.id()
+}
+
+func (c *Conn) id() string {
+	if c.ids != nil {
+		return c.ids.NewID()
+	}
+	return id()
+}
+
+// countingConn counts the bytes read from and written to the socket, beneath
+// any TLS layer.
+type countingConn struct {
+	net.Conn
+	c *Conn
 }
 
-type Message struct {
-	Jid         string
-	MentionName string
-	Body        string
+func (cc *countingConn) Read(b []byte) (int, error) {
+	n, err := cc.Conn.Read(b)
+	atomic.AddInt64(&cc.c.read, int64(n))
+	return n, err
 }
 
+func (cc *countingConn) Write(b []byte) (int, error) {
+	n, err := cc.Conn.Write(b)
+	atomic.AddInt64(&cc.c.written, int64(n))
+	return n, err
+}
+
+// Stream opens the stream to host, from jid unless it is empty, as it is
+// before an anonymous login.
 func (c *Conn) Stream(jid, host string) {
-	fmt.Fprintf(c.outgoing, xmlStream, jid, host, NsJabberClient, NsStream)
+	var attr string
+	if jid != "" {
+		attr = fmt.Sprintf(" from='%s'", escape(jid))
+	}
+	fmt.Fprintf(c.outgoing, xmlStream, attr, escape(host), NsJabberClient, NsStream)
 }
 
 func (c *Conn) StartTLS() {
 	fmt.Fprintf(c.outgoing, xmlStartTLS, NsTLS)
 }
 
-func (c *Conn) UseTLS() {
-	c.outgoing = tls.Client(c.outgoing, &tls.Config{ServerName: "chat.hipchat.com"})
-	c.incoming = xml.NewDecoder(c.outgoing)
+// UseTLS upgrades the connection to TLS after the server agreed to StartTLS,
+// and returns any error from the handshake.
+func (c *Conn) UseTLS(config *tls.Config) error {
+	c.traceIn()
+	conn := tls.Client(c.outgoing.(*tracingConn).Conn, config)
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.outgoing = &tracingConn{Conn: conn, c: c}
+	c.mu.Unlock()
+	c.newDecoder(c.outgoing)
+	c.inbound.Reset()
+	c.traced = 0
+	return nil
+}
+
+// TLSState returns the state of the TLS connection, and false if the
+// connection is not using TLS or was never established.
+func (c *Conn) TLSState() (tls.ConnectionState, bool) {
+	traced, ok := c.out().(*tracingConn)
+	if !ok {
+		return tls.ConnectionState{}, false
+	}
+	if conn, ok := traced.Conn.(*tls.Conn); ok {
+		return conn.ConnectionState(), true
+	}
+	return tls.ConnectionState{}, false
 }
 
 func (c *Conn) Auth(user, pass, resource string) {
-	fmt.Fprintf(c.outgoing, xmlIqSet, id(), NsIqAuth, user, pass, resource)
+	fmt.Fprintf(c.outgoing, xmlIqSet, c.id(), NsJabberClient, NsIqAuth, escape(user), escape(pass), escape(resource))
+}
+
+// SASLAuth starts SASL authentication with the base64 encoded initial response,
+// "=" for an empty one.
+func (c *Conn) SASLAuth(mechanism, response string) error {
+	_, err := fmt.Fprintf(c.outgoing, xmlSASLAuth, NsSASL, escape(mechanism), escape(response))
+	return err
 }
 
-func (c *Conn) Features() *features {
+// SASLFailure decodes the SASL failure that begins with start and returns its
+// condition, such as "not-authorized" or "invalid-authzid", and text, if the
+// server gave one.
+func (c *Conn) SASLFailure(start *xml.StartElement) (condition, text string) {
+	f := new(saslFailure)
+	c.decode(f, start)
+	for _, cond := range f.Conditions {
+		if cond.XMLName.Space == NsSASL && cond.XMLName.Local != "text" {
+			return cond.XMLName.Local, f.Text
+		}
+	}
+	return "", f.Text
+}
+
+func (c *Conn) Bind(resource string) (string, error) {
+	bid := c.id()
+	return bid, c.iq(bid, "set", "", "", fmt.Sprintf(xmlBind, NsBind, escape(resource)))
+}
+
+// Features reads the stream features, which must be the first element after
+// the stream header.
+func (c *Conn) Features() (*features, error) {
+	start, err := c.Next()
+	if err != nil {
+		return nil, err
+	}
+	if start.Name.Local != "features" || start.Name.Space != NsStream {
+		return nil, fmt.Errorf("expected stream features, received %s", start.Name.Local)
+	}
+
 	var f features
-	c.incoming.DecodeElement(&f, nil)
-	return &f
+	if err := c.decode(&f, &start); err != nil {
+		return nil, err
+	}
+	return &f, nil
 }
 
+// Next returns the start of the next element, skipping everything else read
+// before it, such as the whitespace servers send between stanzas to keep the
+// connection open.
 func (c *Conn) Next() (xml.StartElement, error) {
 	var element xml.StartElement
+	c.traceIn()
+	if c.err != nil {
+		return element, c.err
+	}
 
 	for {
-		var err error
-		var t xml.Token
-		t, err = c.incoming.Token()
+		t, err := c.incoming.Token()
 		if err != nil {
+			c.err = err
 			return element, err
 		}
 
-		switch t := t.(type) {
-		case xml.StartElement:
+		if t, ok := t.(xml.StartElement); ok {
 			element = t
 			if element.Name.Local == "" {
-				return element, errors.New("invalid xml response")
+				c.err = errors.New("invalid xml response")
+				return element, c.err
 			}
 
 			return element, nil
+		}
+	}
+}
+
+// Discover asks to for its items with a request with the given id, see NewID.
+// The requests below that take an id work the same way.
+func (c *Conn) Discover(id, from, to string) error {
+	_, err := fmt.Fprintf(c.outgoing, xmlIqGet, escape(from), escape(to), escape(id), NsJabberClient, NsDisco)
+	return err
+}
+
+func (c *Conn) DiscoInfo(id, from, to string) error {
+	_, err := fmt.Fprintf(c.outgoing, xmlIqGet, escape(from), escape(to), escape(id), NsJabberClient, NsDiscoInfo)
+	return err
+}
+
+// DiscoInfoNode asks to for the features of one of its nodes, such as the
+// node its entity capabilities name.
+func (c *Conn) DiscoInfoNode(id, from, to, node string) error {
+	_, err := fmt.Fprintf(c.outgoing, xmlIqGetNode, escape(from), escape(to), escape(id), NsJabberClient, NsDiscoInfo, escape(node))
+	return err
+}
+
+func (c *Conn) LastActivity(id, from, to string) error {
+	_, err := fmt.Fprintf(c.outgoing, xmlIqGet, escape(from), escape(to), escape(id), NsJabberClient, NsIqLast)
+	return err
+}
+
+// decode decodes the element that begins with start, or the next element if
+// start is nil, and traces it.
+func (c *Conn) decode(v interface{}, start *xml.StartElement) error {
+	err := c.incoming.DecodeElement(v, start)
+	c.traceIn()
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+	return err
+}
+
+// Err returns the error that ended reading the stream, such as a stanza cut
+// off by the connection dropping. Once it is set, the stanza last decoded may
+// be incomplete and Next returns the error.
+func (c *Conn) Err() error {
+	return c.err
+}
 
-		default:
+func (c *Conn) ReadPresence(start *xml.StartElement) *presence {
+	p := new(presence)
+	c.decode(p, start)
+	return p
+}
+
+func (c *Conn) Message(start *xml.StartElement) *message {
+	m := new(message)
+	c.decode(m, start)
+	return m
+}
+
+func (c *Conn) IQ(start *xml.StartElement) *IQ {
+	i := new(IQ)
+	c.decode(i, start)
+	return i
+}
+
+// RosterStream decodes the iq that begins with start like IQ, except that the
+// items of a roster in it are passed to each as they are decoded rather than
+// collected in Query.Items, so that a large roster is never held in memory at
+// once.
+func (c *Conn) RosterStream(start *xml.StartElement, each func(jid, name, mentionName, subscription string, groups []string)) *IQ {
+	r := &rosterIQ{Query: &rosterQuery{Items: func(i *item) {
+		each(i.Jid, i.Name, i.MentionName, i.Subscription, i.Groups)
+	}}}
+	c.decode(r, start)
+
+	i := &IQ{XMLName: r.XMLName, ID: r.ID, Type: r.Type, From: r.From, Error: r.Error}
+	if r.Query != nil {
+		i.Query = &query{XMLName: r.Query.XMLName}
+	}
+	return i
+}
+
+func (c *Conn) StreamError(start *xml.StartElement) *streamError {
+	e := new(streamError)
+	c.decode(e, start)
+	for _, cond := range e.Conditions {
+		if cond.XMLName.Space == NsStreams {
+			e.Condition = cond.XMLName.Local
 		}
 	}
-	panic("unreachable")
+	return e
 }
 
-func (c *Conn) Discover(from, to string) {
-	fmt.Fprintf(c.outgoing, xmlIqGet, from, to, id(), NsDisco)
+func (c *Conn) Presence(jid, pres string) error {
+	_, err := fmt.Fprintf(c.outgoing, xmlPresence, escape(jid), NsJabberClient, escape(pres))
+	return err
 }
 
-func (c *Conn) Body() string {
-	b := new(body)
-	c.incoming.DecodeElement(b, nil)
-	return b.Body
+func (c *Conn) Status(jid, show, status string) error {
+	_, err := fmt.Fprintf(c.outgoing, xmlStatus, escape(jid), NsJabberClient, escape(show), escape(status))
+	return err
 }
 
-func (c *Conn) Query() *query {
-	q := new(query)
-	c.incoming.DecodeElement(q, nil)
-	return q
+// Subscription sends a presence subscription stanza of type typ, such as
+// "subscribe" or "unsubscribed".
+func (c *Conn) Subscription(from, to, typ string) error {
+	_, err := fmt.Fprintf(c.outgoing, xmlSubscribe, escape(from), escape(to), escape(typ), NsJabberClient)
+	return err
 }
 
-func (c *Conn) Presence(jid, pres string) {
-	fmt.Fprintf(c.outgoing, xmlPresence, jid, pres)
+func (c *Conn) MUCStatus(roomId, jid, show, status string) error {
+	_, err := fmt.Fprintf(c.outgoing, xmlMUCStatus, escape(jid), escape(roomId), NsJabberClient, escape(show), escape(status))
+	return err
 }
 
-func (c *Conn) MUCPresence(roomId, jid string) {
-	fmt.Fprintf(c.outgoing, xmlMUCPresence, id(), roomId, jid, NsMuc)
+func (c *Conn) MUCPresence(roomId, jid string) error {
+	_, err := fmt.Fprintf(c.outgoing, xmlMUCPresence, c.id(), escape(roomId), escape(jid), NsJabberClient, NsMuc)
+	return err
 }
 
-func (c *Conn) MUCSend(to, from, body string) {
-	fmt.Fprintf(c.outgoing, xmlMUCMessage, from, id(), to, html.EscapeString(body))
+// MUCPart leaves a room.
+func (c *Conn) MUCPart(roomId, jid string) error {
+	_, err := fmt.Fprintf(c.outgoing, xmlMUCPart, c.id(), escape(roomId), escape(jid), NsJabberClient)
+	return err
 }
-func (c *Conn) Send(to, from, body string) {
-	fmt.Fprintf(c.outgoing, xmlMessage, from, id(), to, html.EscapeString(body))
+
+// MUCJoin joins a room with the given password, if not empty, asking for at
+// most maxStanzas messages of history sent since since, if not zero. A negative
+// maxStanzas does not limit the number of messages, leaving the amount of
+// history to the room unless since is set.
+func (c *Conn) MUCJoin(roomId, jid, password string, maxStanzas int, since time.Time) error {
+	var x string
+	if password != "" {
+		x = fmt.Sprintf("<password>%s</password>", escape(password))
+	}
+	if maxStanzas >= 0 || !since.IsZero() {
+		var attrs string
+		if maxStanzas >= 0 {
+			attrs = fmt.Sprintf(" maxstanzas='%d'", maxStanzas)
+		}
+		if !since.IsZero() {
+			attrs += fmt.Sprintf(" since='%s'", since.UTC().Format(time.RFC3339))
+		}
+		x += fmt.Sprintf("<history%s/>", attrs)
+	}
+	_, err := fmt.Fprintf(c.outgoing, xmlMUCJoin, c.id(), escape(roomId), escape(jid), NsJabberClient, NsMuc, x)
+	return err
+}
+
+func (c *Conn) MUCSend(to, from, body string) (string, error) {
+	return c.message("groupchat", to, from, body, "")
+}
+
+// MUCSendID works like MUCSend, but sends the message with the given id, see
+// NewID, for callers that must expect the room's echo before it arrives.
+func (c *Conn) MUCSendID(id, to, from, body string) error {
+	_, err := fmt.Fprintf(c.outgoing, xmlMessage, escape(from), escape(id), escape(to), "groupchat", NsJabberClient, escape(body), "")
+	return err
+}
+
+func (c *Conn) MUCReplace(to, from, replaceId, body string) (string, error) {
+	return c.message("groupchat", to, from, body, fmt.Sprintf(xmlReplace, escape(replaceId), NsCorrect))
+}
+
+func (c *Conn) MUCSubject(to, from, subject string) error {
+	_, err := fmt.Fprintf(c.outgoing, xmlMUCSubject, escape(from), c.id(), escape(to), NsJabberClient, escape(subject))
+	return err
+}
+
+// Marker sends a chat marker of the given type, "received", "displayed" or
+// "acknowledged", for the message with id markedId.
+func (c *Conn) Marker(typ, to, from, marker, markedId string) error {
+	_, err := fmt.Fprintf(c.outgoing, xmlMarker, escape(from), c.id(), escape(to), typ, NsJabberClient, marker, escape(markedId), NsChatMarkers)
+	return err
 }
 
-func (c *Conn) Roster(from, to string) {
-	fmt.Fprintf(c.outgoing, xmlIqGet, from, to, id(), NsIqRoster)
+// Receipt sends a delivery receipt (XEP-0184) for the chat with the given id.
+func (c *Conn) Receipt(to, from, receivedId string) error {
+	_, err := fmt.Fprintf(c.outgoing, xmlMarker, escape(from), c.id(), escape(to), "chat", NsJabberClient, "received", escape(receivedId), NsReceipts)
+	return err
+}
+
+func (c *Conn) MUCReply(to, from, replyId, body string) (string, error) {
+	return c.message("groupchat", to, from, body, fmt.Sprintf(xmlReply, escape(replyId), NsReply))
+}
+
+func (c *Conn) Reply(to, from, replyId, body string) (string, error) {
+	return c.message("chat", to, from, body, fmt.Sprintf(xmlReply, escape(replyId), NsReply))
+}
+
+func (c *Conn) Send(to, from, body string) (string, error) {
+	return c.message("chat", to, from, body, "")
+}
+
+func (c *Conn) Replace(to, from, replaceId, body string) (string, error) {
+	return c.message("chat", to, from, body, fmt.Sprintf(xmlReplace, escape(replaceId), NsCorrect))
+}
+
+// message sends a message stanza with the given body followed by the already
+// escaped extension elements in ext, and returns the stanza's id.
+func (c *Conn) message(typ, to, from, body, ext string) (string, error) {
+	mid := c.id()
+	_, err := fmt.Fprintf(c.outgoing, xmlMessage, escape(from), mid, escape(to), typ, NsJabberClient, escape(body), ext)
+	return mid, err
+}
+
+func (c *Conn) Roster(id, from, to string) error {
+	_, err := fmt.Fprintf(c.outgoing, xmlIqGet, escape(from), escape(to), escape(id), NsJabberClient, NsIqRoster)
+	return err
+}
+
+func (c *Conn) Result(to, id string) error {
+	return c.iq(id, "result", "", to, "")
+}
+
+// VersionResult answers the software version query (XEP-0092) with the given
+// id.
+func (c *Conn) VersionResult(to, id, name, version string) error {
+	return c.iq(id, "result", "", to, fmt.Sprintf(xmlVersion, NsIqVersion, escape(name), escape(version)))
+}
+
+// TimeResult answers the entity time query (XEP-0202) with the given id with
+// t, in its location's offset from UTC.
+func (c *Conn) TimeResult(to, id string, t time.Time) error {
+	return c.iq(id, "result", "", to, fmt.Sprintf(xmlTime, NsTime, t.Format("-07:00"), t.UTC().Format("2006-01-02T15:04:05Z")))
+}
+
+func (c *Conn) Ping(id, from, to string) error {
+	return c.iq(id, "get", from, to, fmt.Sprintf(xmlPing, NsPing))
+}
+
+// EnableCarbons asks the server to copy messages sent and received by the
+// account's other sessions to this one.
+func (c *Conn) EnableCarbons(from string) (string, error) {
+	cid := c.id()
+	return cid, c.iq(cid, "set", from, "", fmt.Sprintf(xmlCarbons, NsCarbons))
+}
+
+// iq sends an iq stanza with the already escaped payload. Empty from and to
+// attributes are left out.
+func (c *Conn) iq(id, typ, from, to, payload string) error {
+	var attrs string
+	if from != "" {
+		attrs += fmt.Sprintf(" from='%s'", escape(from))
+	}
+	if to != "" {
+		attrs += fmt.Sprintf(" to='%s'", escape(to))
+	}
+	_, err := fmt.Fprintf(c.outgoing, xmlIq, attrs, escape(id), typ, NsJabberClient, payload)
+	return err
+}
+
+func (c *Conn) Raw(stanza string) error {
+	_, err := fmt.Fprint(c.outgoing, stanza)
+	return err
 }
 
 func (c *Conn) KeepAlive() {
 	fmt.Fprintf(c.outgoing, " ")
 }
 
-func Dial(host string) (*Conn, error) {
-	c := new(Conn)
-	outgoing, err := net.Dial("tcp", host+":5222")
+// Unavailable tells the server the client is going offline.
+func (c *Conn) Unavailable(jid string) error {
+	_, err := fmt.Fprintf(c.outgoing, xmlUnavailable, escape(jid), NsJabberClient)
+	return err
+}
+
+// SetDeadline sets the deadline for reading from and writing to the
+// connection.
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.out().SetDeadline(t)
+}
+
+func (c *Conn) Close() error {
+	out := c.out()
+	if out == nil {
+		return nil
+	}
+	fmt.Fprint(out, xmlStreamEnd)
+	return out.Close()
+}
+
+// out returns the connection written to, for the methods that may be called
+// while another goroutine is negotiating the connection, such as Close.
+func (c *Conn) out() net.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.outgoing
+}
+
+func Dial(addr string) (*Conn, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "5222")
+	}
+	outgoing, err := net.Dial("tcp", addr)
 
 	if err != nil {
-		return c, err
+		return new(Conn), err
 	}
 
-	c.outgoing = outgoing
-	c.incoming = xml.NewDecoder(outgoing)
+	return NewConn(outgoing), nil
+}
+
+// NewConn returns a Conn that talks XMPP over conn, an already established
+// connection to the server.
+func NewConn(conn net.Conn) *Conn {
+	c := &Conn{socket: conn}
+	c.outgoing = &tracingConn{Conn: &countingConn{Conn: conn, c: c}, c: c}
+	c.newDecoder(c.outgoing)
+	return c
+}
+
+// SetTCPKeepAlive turns TCP keepalives on the socket on, probing every
+// period, or off if period is negative. It does nothing for connections that
+// are not TCP.
+func (c *Conn) SetTCPKeepAlive(period time.Duration) error {
+	conn, ok := c.socket.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if period < 0 {
+		return conn.SetKeepAlive(false)
+	}
+	if err := conn.SetKeepAlive(true); err != nil {
+		return err
+	}
+	return conn.SetKeepAlivePeriod(period)
+}
+
+func (c *Conn) BytesRead() int64 {
+	return atomic.LoadInt64(&c.read)
+}
 
-	return c, nil
+func (c *Conn) BytesWritten() int64 {
+	return atomic.LoadInt64(&c.written)
 }
 
 func ToMap(attr []xml.Attr) map[string]string {
@@ -175,6 +894,11 @@ func ToMap(attr []xml.Attr) map[string]string {
 	return m
 }
 
+// escape makes s safe to use as character data or a quoted attribute value.
+func escape(s string) string {
+	return html.EscapeString(s)
+}
+
 func id() string {
 	b := make([]byte, 8)
 	io.ReadFull(rand.Reader, b)
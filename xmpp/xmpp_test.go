@@ -0,0 +1,102 @@
+package xmpp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// recorder is a connection that records what is written to it.
+type recorder struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (r *recorder) Read(b []byte) (int, error)  { return 0, io.EOF }
+func (r *recorder) Write(b []byte) (int, error) { return r.written.Write(b) }
+
+// counter makes the ids "1", "2" and so on.
+type counter int
+
+func (c *counter) NewID() string {
+	*c++
+	return strconv.Itoa(int(*c))
+}
+
+func TestOutgoingStanzas(t *testing.T) {
+	const (
+		room = "1_dev'&<@conf.hipchat.com"
+		from = "1_2@chat.hipchat.com/\"bot\""
+		body = `<b>Tom & "Jerry"</b> isn't`
+	)
+	since := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		send func(*Conn) error
+		want string
+	}{
+		{
+			name: "stream",
+			send: func(c *Conn) error { c.Stream(from, "chat.hipchat.com"); return nil },
+			want: `<stream:stream from='1_2@chat.hipchat.com/&#34;bot&#34;' to='chat.hipchat.com' version='1.0' xml:lang='en' xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams'>`,
+		},
+		{
+			name: "chat",
+			send: func(c *Conn) error { _, err := c.Send("1_3@chat.hipchat.com", from, body); return err },
+			want: `<message from='1_2@chat.hipchat.com/&#34;bot&#34;' id='1' to='1_3@chat.hipchat.com' type='chat' xmlns='jabber:client'><body>&lt;b&gt;Tom &amp; &#34;Jerry&#34;&lt;/b&gt; isn&#39;t</body></message>`,
+		},
+		{
+			name: "groupchat",
+			send: func(c *Conn) error { _, err := c.MUCSend(room, from, body); return err },
+			want: `<message from='1_2@chat.hipchat.com/&#34;bot&#34;' id='1' to='1_dev&#39;&amp;&lt;@conf.hipchat.com' type='groupchat' xmlns='jabber:client'><body>&lt;b&gt;Tom &amp; &#34;Jerry&#34;&lt;/b&gt; isn&#39;t</body></message>`,
+		},
+		{
+			name: "correction",
+			send: func(c *Conn) error { _, err := c.Replace("1_3@chat.hipchat.com", from, "a'1", "fixed"); return err },
+			want: `<message from='1_2@chat.hipchat.com/&#34;bot&#34;' id='1' to='1_3@chat.hipchat.com' type='chat' xmlns='jabber:client'><body>fixed</body><replace id='a&#39;1' xmlns='urn:xmpp:message-correct:0'/></message>`,
+		},
+		{
+			name: "join",
+			send: func(c *Conn) error { return c.MUCJoin(room+"/Bot", from, "p'w<", 0, since) },
+			want: `<presence id='1' to='1_dev&#39;&amp;&lt;@conf.hipchat.com/Bot' from='1_2@chat.hipchat.com/&#34;bot&#34;' xmlns='jabber:client'><x xmlns='http://jabber.org/protocol/muc'><password>p&#39;w&lt;</password><history maxstanzas='0' since='2017-01-02T03:04:05Z'/></x></presence>`,
+		},
+		{
+			name: "part",
+			send: func(c *Conn) error { return c.MUCPart(room+"/Bot", from) },
+			want: `<presence id='1' to='1_dev&#39;&amp;&lt;@conf.hipchat.com/Bot' from='1_2@chat.hipchat.com/&#34;bot&#34;' type='unavailable' xmlns='jabber:client'/>`,
+		},
+		{
+			name: "status",
+			send: func(c *Conn) error { return c.Status(from, "dnd", "in <meetings> & calls") },
+			want: `<presence from='1_2@chat.hipchat.com/&#34;bot&#34;' xmlns='jabber:client'><show>dnd</show><status>in &lt;meetings&gt; &amp; calls</status></presence>`,
+		},
+		{
+			name: "subject",
+			send: func(c *Conn) error { return c.MUCSubject(room, from, "Q&A") },
+			want: `<message from='1_2@chat.hipchat.com/&#34;bot&#34;' id='1' to='1_dev&#39;&amp;&lt;@conf.hipchat.com' type='groupchat' xmlns='jabber:client'><subject>Q&amp;A</subject></message>`,
+		},
+		{
+			name: "roster",
+			send: func(c *Conn) error { return c.Roster(c.NewID(), from, "chat.hipchat.com") },
+			want: `<iq from='1_2@chat.hipchat.com/&#34;bot&#34;' to='chat.hipchat.com' id='1' type='get' xmlns='jabber:client'><query xmlns='jabber:iq:roster'/></iq>`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := new(recorder)
+			c := NewConn(r)
+			c.SetIDGenerator(new(counter))
+			if err := test.send(c); err != nil {
+				t.Fatal(err)
+			}
+			if got := r.written.String(); got != test.want {
+				t.Errorf("wrote\n%s\nwant\n%s", got, test.want)
+			}
+		})
+	}
+}